@@ -0,0 +1,122 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package ciphersuite2_test
+
+import (
+	"github.com/mad-day/cryptoinfra/ciphersuite2"
+	"github.com/mad-day/cryptoinfra/format2"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/aesmodes"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/aez"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/chacha20poly1305"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/hs1siv"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/morus"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/pk25519"
+)
+
+// A file in memory, that implements format2.AppendFile.
+type fileBuffer struct { b []byte }
+func (f *fileBuffer) ReadAt(p []byte,off int64) (int,error) {
+	if off>=int64(len(f.b)) { return 0,io.EOF }
+	n := copy(p,f.b[off:])
+	if n<len(p) { return n,io.EOF }
+	return n,nil
+}
+func (f *fileBuffer) WriteAt(p []byte,off int64) (int,error) {
+	if e := off+int64(len(p)); e>int64(len(f.b)) { f.b = append(f.b,make([]byte,e-int64(len(f.b)))...) }
+	return copy(f.b[off:],p),nil
+}
+func (f *fileBuffer) Truncate(size int64) error {
+	if size<int64(len(f.b)) { f.b = f.b[:size] }
+	return nil
+}
+
+func readStream(ct []byte,d format2.Decrypter) ([]byte,error) {
+	r,err := format2.NewReader2(bytes.NewReader(ct),d,nil)
+	if err!=nil { return nil,err }
+	return ioutil.ReadAll(r)
+}
+
+var aeadEncodings = []string{
+	"aes-256/eax",
+	"aes-256/gcm",
+	"chacha20-poly1305",
+	"xchacha20-poly1305",
+	"aez",
+	"hs1siv",
+	"morus-1280-256",
+}
+
+/*
+Round trips over the AEAD encodings, with chunk nonces, key epochs and appended sessions.
+RekeyChunks fails with format2.ERekey, unless the encoding derives the next key epoch.
+*/
+func TestAEADEncodings(t *testing.T) {
+	pub,priv,err := ciphersuite2.GenerateKeyPair(rand.Reader,"curve25519")
+	if err!=nil { t.Fatal(err) }
+	pk,err := ciphersuite2.LoadPublicKey("curve25519",pub)
+	if err!=nil { t.Fatal(err) }
+	sk,err := ciphersuite2.LoadPrivateKey("curve25519",priv)
+	if err!=nil { t.Fatal(err) }
+	dec := ciphersuite2.Decrypt(ciphersuite2.AsKeyRing(sk))
+	data := make([]byte,5000)
+	rand.Read(data)
+	opt := &format2.WriterOptions{ChunkSize:1024,RekeyChunks:2,Index:true}
+	
+	for _,encoding := range aeadEncodings {
+		buf := new(bytes.Buffer)
+		w,err := format2.NewWriter2(buf,&ciphersuite2.EncryptionContext{PublicKey:pk,PK_Algo:"curve25519",Encoding:encoding,Random:rand.Reader},opt)
+		if err!=nil { t.Fatalf("%s: %v",encoding,err) }
+		_,err = w.Write(data)
+		if err==nil { err = w.Close() }
+		if err!=nil { t.Fatalf("%s: %v",encoding,err) }
+		f := &fileBuffer{buf.Bytes()}
+		pt,err := readStream(f.b,dec)
+		if err!=nil || !bytes.Equal(pt,data) { t.Fatalf("%s: %v",encoding,err) }
+		
+		want := append([]byte(nil),data...)
+		for i := 0; i<2; i++ {
+			w,err = format2.Append(f,int64(len(f.b)),dec,opt)
+			if err!=nil { t.Fatalf("%s: Append: %v",encoding,err) }
+			_,err = w.Write(data[:3000])
+			if err==nil { err = w.Close() }
+			if err!=nil { t.Fatalf("%s: Append: %v",encoding,err) }
+			want = append(want,data[:3000]...)
+		}
+		pt,err = readStream(f.b,dec)
+		if err!=nil || !bytes.Equal(pt,want) { t.Fatalf("%s: after Append: %v",encoding,err) }
+		
+		c := append([]byte(nil),f.b...)
+		c[len(c)/2] ^= 1
+		_,err = readStream(c,dec)
+		var se *format2.StreamError
+		if !errors.As(err,&se) || se.Kind!=format2.KindAuth { t.Errorf("%s: tampered: got %v",encoding,err) }
+	}
+}
@@ -114,14 +114,51 @@ func (c *BlockCipher) crypt(b *ciphersuite2.Cipher_Buffer,en bool) (*format2.Cip
 		}
 	case CTR:
 		obj.Stream = cipher.NewCTR(block,b.IV)
+		obj.StreamAt = ctrAt(block,b.IV)
 	case OFB:
 		obj.Stream = cipher.NewOFB(block,b.IV)
+		obj.StreamAt = ofbAt(block,b.IV)
 	case EAX: obj.AEAD,err = eax.New(block,block.BlockSize())
 	default: err = fmt.Errorf("illegal mode 0x%x",c.Mode)
 	}
-	if err!=nil { obj = nil }
+	if err!=nil { obj = nil } else { obj.BlockSize = block.BlockSize() }
 	return obj,err
 }
+
+// Skips n bytes of the key stream.
+func discard(s cipher.Stream,n int64) {
+	buf := make([]byte,4096)
+	for n>0 {
+		if n<int64(len(buf)) { buf = buf[:n] }
+		s.XORKeyStream(buf,buf)
+		n -= int64(len(buf))
+	}
+}
+func ctrAt(block cipher.Block,iv []byte) func(int64) (cipher.Stream,error) {
+	iv = append([]byte(nil),iv...)
+	return func(off int64) (cipher.Stream,error) {
+		bz := int64(block.BlockSize())
+		ctr := append([]byte(nil),iv...)
+		// ctr += off/bz (big endian)
+		carry := uint64(off/bz)
+		for i := len(ctr)-1; i>=0 && carry!=0; i-- {
+			carry += uint64(ctr[i])
+			ctr[i] = byte(carry)
+			carry >>= 8
+		}
+		s := cipher.NewCTR(block,ctr)
+		discard(s,off%bz)
+		return s,nil
+	}
+}
+func ofbAt(block cipher.Block,iv []byte) func(int64) (cipher.Stream,error) {
+	iv = append([]byte(nil),iv...)
+	return func(off int64) (cipher.Stream,error) {
+		s := cipher.NewOFB(block,iv)
+		discard(s,off)
+		return s,nil
+	}
+}
 func (c *BlockCipher) Encrypt(b *ciphersuite2.Cipher_Buffer) (*format2.CipherObject,error) { return c.crypt(b,true) }
 func (c *BlockCipher) Decrypt(b *ciphersuite2.Cipher_Buffer) (*format2.CipherObject,error) { return c.crypt(b,false) }
 
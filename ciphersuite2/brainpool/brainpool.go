@@ -24,7 +24,7 @@ SOFTWARE.
 /*
 European Brainpool ECC curves.
 
-	PK_Algo = (
+	PK_Algo, Sig_Algo = (
 		"brainpool_p160"
 		"brainpool_p192"
 		"brainpool_p224"
@@ -63,5 +63,20 @@ func init() {
 	ciphersuite2.RegisterPkAlgo("brainpool_p320t1",ecc.Wrap(elliptic.P320t1()))
 	ciphersuite2.RegisterPkAlgo("brainpool_p384t1",ecc.Wrap(elliptic.P384t1()))
 	ciphersuite2.RegisterPkAlgo("brainpool_p512t1",ecc.Wrap(elliptic.P512t1()))
+
+	ciphersuite2.RegisterSigAlgo("brainpool_p160r1",ecc.WrapSig(elliptic.P160r1()))
+	ciphersuite2.RegisterSigAlgo("brainpool_p192r1",ecc.WrapSig(elliptic.P192r1()))
+	ciphersuite2.RegisterSigAlgo("brainpool_p224r1",ecc.WrapSig(elliptic.P224r1()))
+	ciphersuite2.RegisterSigAlgo("brainpool_p256r1",ecc.WrapSig(elliptic.P256r1()))
+	ciphersuite2.RegisterSigAlgo("brainpool_p320r1",ecc.WrapSig(elliptic.P320r1()))
+	ciphersuite2.RegisterSigAlgo("brainpool_p384r1",ecc.WrapSig(elliptic.P384r1()))
+	ciphersuite2.RegisterSigAlgo("brainpool_p512r1",ecc.WrapSig(elliptic.P512r1()))
+	ciphersuite2.RegisterSigAlgo("brainpool_p160t1",ecc.WrapSig(elliptic.P160t1()))
+	ciphersuite2.RegisterSigAlgo("brainpool_p192t1",ecc.WrapSig(elliptic.P192t1()))
+	ciphersuite2.RegisterSigAlgo("brainpool_p224t1",ecc.WrapSig(elliptic.P224t1()))
+	ciphersuite2.RegisterSigAlgo("brainpool_p256t1",ecc.WrapSig(elliptic.P256t1()))
+	ciphersuite2.RegisterSigAlgo("brainpool_p320t1",ecc.WrapSig(elliptic.P320t1()))
+	ciphersuite2.RegisterSigAlgo("brainpool_p384t1",ecc.WrapSig(elliptic.P384t1()))
+	ciphersuite2.RegisterSigAlgo("brainpool_p512t1",ecc.WrapSig(elliptic.P512t1()))
 }
 
@@ -27,6 +27,7 @@ package ciphersuite2
 import (
 	"github.com/mad-day/cryptoinfra/format2"
 	"io"
+	"sort"
 )
 
 type UnknownCipherError string
@@ -94,6 +95,22 @@ type Cipher_Driver interface {
 func RegisterCipher(str string,ciph Cipher_Driver) { cipher_drivers[str] = ciph }
 func RegisterPkAlgo(str string,pka Pka_Driver) { pka_drivers[str] = pka }
 
+// Returns the names of all registered Encodings, sorted.
+func Ciphers() []string {
+	names := make([]string,0,len(cipher_drivers))
+	for name := range cipher_drivers { names = append(names,name) }
+	sort.Strings(names)
+	return names
+}
+
+// Returns the names of all registered PK_Algos, sorted.
+func PkAlgos() []string {
+	names := make([]string,0,len(pka_drivers))
+	for name := range pka_drivers { names = append(names,name) }
+	sort.Strings(names)
+	return names
+}
+
 type DecryptionContext struct{
 	KeyRing KeyRing
 	KeyRing2 KeyRing2
@@ -108,17 +125,18 @@ func (d *DecryptionContext) getKey2(opaque []byte,pk_algo string) (n_opaque []by
 	return
 }
 func (d *DecryptionContext) StartDecryption(p *format2.Preamble) (*format2.CipherObject,error) {
-	opaque,pubk,err := d.getKey2(p.Opaque,p.PK_Algo)
-	if err!=nil { return nil,err }
-	
 	enc,ok := cipher_drivers[p.Encoding]
 	if !ok { return nil,UnknownCipherError(p.Encoding) }
+	if len(p.Recipients)>0 { return d.startMulti(p,enc) }
+	
+	opaque,pubk,err := d.getKey2(p.Opaque,p.PK_Algo)
+	if err!=nil { return nil,err }
 	pka,ok := pka_drivers[p.PK_Algo]
 	if !ok { return nil,UnknownPkaError(p.PK_Algo) }
 	cb := enc.Keybuf()
 	err = pka.DecryptKey(opaque,pubk,cb)
 	if err!=nil { return nil,err }
-	return enc.Decrypt(cb)
+	return startCipher(enc,cb,false)
 }
 // Non-Wrapped only.
 func Decrypt(kr KeyRing) *DecryptionContext { return &DecryptionContext{kr,nil} }
@@ -126,32 +144,55 @@ func Decrypt(kr KeyRing) *DecryptionContext { return &DecryptionContext{kr,nil}
 // Wrapped only.
 func Decrypt2(kr KeyRing2) *DecryptionContext { return &DecryptionContext{nil,kr} }
 
-/* Encrypter for non-Wrapped Opaques. */
+/*
+Encrypter for non-Wrapped Opaques.
+
+The stream is encrypted with a random content key. The PK_Algo only wraps it, in a single
+recipient stanza as with MultiEncryptionContext, so the stream can be rewrapped for another
+key later (see RewrapContext). Older streams, whose key has been derived from the key exchange
+directly, are still decrypted.
+*/
 type EncryptionContext struct {
 	PublicKey PublicKey
 	PK_Algo   string
 	Encoding  string
 	Random    io.Reader
+	
+	// If set, the content key is stored into it.
+	Session   *SessionKey
 }
 func (e *EncryptionContext) StartEncryption() (*format2.Preamble, *format2.CipherObject, error) {
-	enc,ok := cipher_drivers[e.Encoding]
-	if !ok { return nil,nil,UnknownCipherError(e.Encoding) }
-	pka,ok := pka_drivers[e.PK_Algo]
-	if !ok { return nil,nil,UnknownPkaError(e.PK_Algo) }
-	
-	cb := enc.Keybuf()
-	opaque,err := pka.EncryptKey(e.Random,e.PublicKey,cb)
-	if err!=nil { return nil,nil,err }
-	
-	ciph,err := enc.Encrypt(cb)
-	if err!=nil { return nil,nil,err }
-	
-	return &format2.Preamble{
-		Opaque:opaque,
-		PK_Algo:e.PK_Algo,
+	m := &MultiEncryptionContext{
+		Recipients:[]RecipientKey{{PublicKey:e.PublicKey,PK_Algo:e.PK_Algo}},
 		Encoding:e.Encoding,
-	},ciph,nil
+		Random:e.Random,
+		Session:e.Session,
+	}
+	return m.StartEncryption()
+}
+/*
+A retained content key. It decrypts the stream, it has been captured from (see
+EncryptionContext.Session), without the private key, for instance to continue
+it with format2.Append. It must be kept as secret as a private key.
+*/
+type SessionKey struct {
+	Encoding string
+	Key      []byte
+	IV       []byte
+}
+func (s *SessionKey) capture(encoding string,cb *Cipher_Buffer) {
+	s.Encoding = encoding
+	s.Key = append([]byte(nil),cb.Key...)
+	s.IV = append([]byte(nil),cb.IV...)
+}
+func (s *SessionKey) StartDecryption(p *format2.Preamble) (*format2.CipherObject,error) {
+	if p.Encoding!=s.Encoding { return nil,UnknownCipherError(p.Encoding) }
+	enc,ok := cipher_drivers[s.Encoding]
+	if !ok { return nil,UnknownCipherError(s.Encoding) }
+	cb := &Cipher_Buffer{Key:append([]byte(nil),s.Key...),IV:append([]byte(nil),s.IV...)}
+	return startCipher(enc,cb,false)
 }
+
 func GenerateKeyPair(rand io.Reader,pk_algo string) (pub, priv []byte, err error) {
 	pka,ok := pka_drivers[pk_algo]
 	if !ok { return nil,nil,UnknownPkaError(pk_algo) }
@@ -171,4 +212,43 @@ func LoadPrivateKey(pk_algo string,priv []byte) (PrivateKey,error) {
 	return pka.LoadPrivate(priv)
 }
 
+/*
+Key encapsulation with a registered PK_Algo: derives a shared secret into cb and returns
+the Opaque, from which the holder of the private key recovers it with DecryptKey.
+*/
+func EncryptKey(rand io.Reader,pk_algo string,pubk PublicKey,cb *Cipher_Buffer) (opaque []byte,err error) {
+	pka,ok := pka_drivers[pk_algo]
+	if !ok { return nil,UnknownPkaError(pk_algo) }
+	
+	return pka.EncryptKey(rand,pubk,cb)
+}
+func DecryptKey(pk_algo string,opaque []byte,prik PrivateKey,cb *Cipher_Buffer) error {
+	pka,ok := pka_drivers[pk_algo]
+	if !ok { return UnknownPkaError(pk_algo) }
+	
+	return pka.DecryptKey(opaque,prik,cb)
+}
+
+// Returns an empty key buffer of the right size for a registered Encoding.
+func Keybuf(encoding string) (*Cipher_Buffer,error) {
+	enc,ok := cipher_drivers[encoding]
+	if !ok { return nil,UnknownCipherError(encoding) }
+	
+	return enc.Keybuf(),nil
+}
 
+// Instantiates a registered Encoding with the key from cb (see Keybuf) for encryption.
+func NewCipher(encoding string,cb *Cipher_Buffer) (*format2.CipherObject,error) {
+	enc,ok := cipher_drivers[encoding]
+	if !ok { return nil,UnknownCipherError(encoding) }
+	
+	return enc.Encrypt(cb)
+}
+
+// Like NewCipher, but for decryption.
+func NewDecipher(encoding string,cb *Cipher_Buffer) (*format2.CipherObject,error) {
+	enc,ok := cipher_drivers[encoding]
+	if !ok { return nil,UnknownCipherError(encoding) }
+	
+	return enc.Decrypt(cb)
+}
@@ -25,6 +25,7 @@ SOFTWARE.
 package ecc
 
 import (
+	"crypto/ecdsa"
 	"crypto/elliptic"
 	
 	"github.com/mad-day/cryptoinfra/ciphersuite2"
@@ -79,4 +80,42 @@ func (p *pka_driver) EncryptKey(rand io.Reader,pubk ciphersuite2.PublicKey,cb *c
 
 func Wrap(curve elliptic.Curve) ciphersuite2.Pka_Driver { return &pka_driver{curve} }
 
+type sig_driver struct {
+	curve elliptic.Curve
+}
+var _ ciphersuite2.Sig_Driver = (*sig_driver)(nil)
+
+func (p *sig_driver) GenerateKeyPair(rand io.Reader) (pub,priv []byte,err error) {
+	return (&pka_driver{p.curve}).GenerateKeyPair(rand)
+}
+func (p *sig_driver) size() int { return (p.curve.Params().N.BitLen()+7)/8 }
+
+// The signature is r||s, each padded to the size of the group order.
+func (p *sig_driver) Sign(rand io.Reader,priv []byte,digest []byte) ([]byte,error) {
+	k := new(ecdsa.PrivateKey)
+	k.Curve = p.curve
+	k.D = new(big.Int).SetBytes(priv)
+	k.X,k.Y = p.curve.ScalarBaseMult(priv)
+	r,s,err := ecdsa.Sign(rand,k,digest)
+	if err!=nil { return nil,err }
+	l := p.size()
+	sig := make([]byte,2*l)
+	rb,sb := r.Bytes(),s.Bytes()
+	copy(sig[l-len(rb):l],rb)
+	copy(sig[2*l-len(sb):],sb)
+	return sig,nil
+}
+func (p *sig_driver) Verify(pub,digest,sig []byte) bool {
+	l := p.size()
+	if len(sig)!=2*l { return false }
+	x,y := elliptic.Unmarshal(p.curve,pub)
+	if x==nil { return false }
+	r := new(big.Int).SetBytes(sig[:l])
+	s := new(big.Int).SetBytes(sig[l:])
+	return ecdsa.Verify(&ecdsa.PublicKey{Curve:p.curve,X:x,Y:y},digest,r,s)
+}
+
+// ECDSA signatures.
+func WrapSig(curve elliptic.Curve) ciphersuite2.Sig_Driver { return &sig_driver{curve} }
+
 
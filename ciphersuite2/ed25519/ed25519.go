@@ -0,0 +1,58 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+This package implements Ed25519 signatures.
+
+	Sig_Algo = (
+		"ed25519"
+	)
+*/
+package ed25519
+
+import (
+	"github.com/mad-day/cryptoinfra/ciphersuite2"
+	ied "golang.org/x/crypto/ed25519"
+	
+	"io"
+)
+
+type sig_driver struct {}
+
+func (*sig_driver) GenerateKeyPair(rand io.Reader) (pub,priv []byte,err error) {
+	return ied.GenerateKey(rand)
+}
+func (*sig_driver) Sign(rand io.Reader,priv []byte,digest []byte) ([]byte,error) {
+	if len(priv)!=ied.PrivateKeySize { return nil,ciphersuite2.MalformedKeyError("Ed25519") }
+	return ied.Sign(ied.PrivateKey(priv),digest),nil
+}
+func (*sig_driver) Verify(pub,digest,sig []byte) bool {
+	if len(pub)!=ied.PublicKeySize { return false }
+	return ied.Verify(ied.PublicKey(pub),digest,sig)
+}
+
+var _ ciphersuite2.Sig_Driver = (*sig_driver)(nil)
+
+func init(){
+	ciphersuite2.RegisterSigAlgo("ed25519",new(sig_driver))
+}
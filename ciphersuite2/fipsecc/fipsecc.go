@@ -24,7 +24,7 @@ SOFTWARE.
 /*
 This package implements the cleptographic ECC curves from FIPS 186-3.
 
-	PK_Algo = (
+	PK_Algo, Sig_Algo = (
 		"fips_p224"
 		"fips_p256"
 		"fips_p384"
@@ -45,5 +45,10 @@ func init() {
 	ciphersuite2.RegisterPkAlgo("fips_p256",ecc.Wrap(elliptic.P256()))
 	ciphersuite2.RegisterPkAlgo("fips_p384",ecc.Wrap(elliptic.P384()))
 	ciphersuite2.RegisterPkAlgo("fips_p521",ecc.Wrap(elliptic.P521()))
+
+	ciphersuite2.RegisterSigAlgo("fips_p224",ecc.WrapSig(elliptic.P224()))
+	ciphersuite2.RegisterSigAlgo("fips_p256",ecc.WrapSig(elliptic.P256()))
+	ciphersuite2.RegisterSigAlgo("fips_p384",ecc.WrapSig(elliptic.P384()))
+	ciphersuite2.RegisterSigAlgo("fips_p521",ecc.WrapSig(elliptic.P521()))
 }
 
@@ -0,0 +1,124 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+Generates and verifies known answer test vectors for all suites of ciphersuite2.
+
+	c2kat -gen vectors.json [-seed cryptoinfra] [-pk curve25519,x448] [-enc aes-128/gcm,aez]
+	c2kat -gen vectors.json -add
+	c2kat -verify vectors.json
+	c2kat -check vectors.json
+
+-add keeps the vectors in the file, and only generates the missing combinations.
+-verify decrypts the vectors. -check also regenerates them, and reports the combinations,
+whose keys or ciphertext changed (unless the suite is not deterministic, see kat.Compare),
+and the registered ones without a vector. Every failing, changed or missing combination is
+printed, and the exit status is 1.
+*/
+package main
+
+import (
+	"github.com/mad-day/cryptoinfra/ciphersuite2/kat"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/aesmodes"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/aez"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/bcns"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/brainpool"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/camellia"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/chacha20poly1305"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/fipsecc"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/hs1siv"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/koblitz"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/koreancrypt"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/morus"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/newhope"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/pk25519"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/twofish"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/x448"
+)
+
+func list(s string) []string {
+	if s=="" { return nil }
+	return strings.Split(s,",")
+}
+
+func fail(fails []*kat.Failure) {
+	for _,f := range fails { fmt.Fprintln(os.Stderr,f) }
+	if len(fails)>0 { os.Exit(1) }
+}
+
+func read(name string) []*kat.Vector {
+	f,err := os.Open(name)
+	if err!=nil { fmt.Fprintln(os.Stderr,err); os.Exit(2) }
+	vs,err := kat.Read(f)
+	f.Close()
+	if err!=nil { fmt.Fprintln(os.Stderr,err); os.Exit(2) }
+	return vs
+}
+
+func write(name string,vs []*kat.Vector) {
+	f,err := os.Create(name)
+	if err==nil { err = kat.Write(f,vs) }
+	if err==nil { err = f.Close() }
+	if err!=nil { fmt.Fprintln(os.Stderr,err); os.Exit(2) }
+	fmt.Printf("%d vectors\n",len(vs))
+}
+
+func main() {
+	gen := flag.String("gen","","write vectors to `file`")
+	verify := flag.String("verify","","verify the vectors in `file`")
+	check := flag.String("check","","verify and regenerate the vectors in `file`")
+	add := flag.Bool("add",false,"with -gen: keep the vectors in the file, generate the missing ones")
+	seed := flag.String("seed","cryptoinfra","seed of the vectors")
+	pk := flag.String("pk","","comma separated PK_Algos (default: all)")
+	enc := flag.String("enc","","comma separated Encodings (default: all)")
+	flag.Parse()
+	
+	switch {
+	case *gen!="" && *add:
+		vs,fails := kat.GenerateMissing(*seed,read(*gen))
+		write(*gen,vs)
+		fail(fails)
+	case *gen!="":
+		vs,fails := kat.GenerateAll(*seed,list(*pk),list(*enc))
+		write(*gen,vs)
+		fail(fails)
+	case *verify!="":
+		vs := read(*verify)
+		fails := kat.Verify(vs)
+		fmt.Printf("%d vectors, %d failed\n",len(vs),len(fails))
+		fail(fails)
+	case *check!="":
+		vs := read(*check)
+		fails := append(kat.CompareAll(vs),kat.Missing(vs)...)
+		fmt.Printf("%d vectors, %d failed, changed or missing\n",len(vs),len(fails))
+		fail(fails)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,257 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+Known answer tests for ciphersuite2 and format2.
+
+For every combination of a registered PK_Algo and Encoding, a format2 stream is generated.
+The key pair, the plaintext and the randomness of the encryption are drawn from a deterministic
+generator, that is seeded with the seed and the names of the algorithms. Check decrypts a
+vector with its private key, so older vectors prove, that a build still reads what older
+builds produced.
+
+Some algorithms do not consume the randomness deterministically (for instance, implementations
+drawing an extra byte), so a regenerated vector may differ. Both remain valid. For all others,
+Compare regenerates a vector and checks, that the ciphertext is still the same, byte for byte.
+
+Only the registered algorithms are covered, so the suites have to be imported. The vectors
+are stored as a JSON array, binary fields in base64:
+
+	[
+		{"pk_algo":"curve25519","encoding":"aes-128/gcm","seed":"...","public":"...","private":"...","plaintext":"...","ciphertext":"..."},
+		...
+	]
+*/
+package kat
+
+import (
+	"github.com/mad-day/cryptoinfra/ciphersuite2"
+	"github.com/mad-day/cryptoinfra/format2"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+var EMismatch = fmt.Errorf("Decrypted Plaintext does not match")
+var EChanged = fmt.Errorf("Regenerated Ciphertext differs")
+var ENoVector = fmt.Errorf("No Vector for this combination")
+
+const (
+	// The size of the plaintext of a vector.
+	PlainSize = 300
+	
+	// The chunk size of the vectors, so that they span several chunks.
+	ChunkSize = 128
+)
+
+type Vector struct {
+	PK_Algo    string `json:"pk_algo"`
+	Encoding   string `json:"encoding"`
+	Seed       string `json:"seed"`
+	Public     []byte `json:"public"`
+	Private    []byte `json:"private"`
+	Plaintext  []byte `json:"plaintext"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+/*
+A combination, that failed to generate or to verify.
+*/
+type Failure struct {
+	PK_Algo  string
+	Encoding string
+	Err      error
+}
+func (f *Failure) Error() string { return f.PK_Algo+" "+f.Encoding+": "+f.Err.Error() }
+
+type zeroes struct{}
+func (zeroes) Read(p []byte) (int,error) {
+	for i := range p { p[i] = 0 }
+	return len(p),nil
+}
+
+/*
+Returns a deterministic source of randomness: AES-256-CTR, keyed with the SHA-256 hash of the parts.
+*/
+func Random(parts ...string) io.Reader {
+	h := sha256.New()
+	for _,p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	b,_ := aes.NewCipher(h.Sum(nil))
+	return cipher.StreamReader{S:cipher.NewCTR(b,make([]byte,aes.BlockSize)),R:zeroes{}}
+}
+
+/*
+Generates the vector of a single combination.
+*/
+func Generate(seed,pk_algo,encoding string) (*Vector,error) {
+	rand := Random(seed,pk_algo,encoding)
+	v := &Vector{PK_Algo:pk_algo,Encoding:encoding,Seed:seed}
+	var err error
+	v.Public,v.Private,err = ciphersuite2.GenerateKeyPair(rand,pk_algo)
+	if err!=nil { return nil,err }
+	pub,err := ciphersuite2.LoadPublicKey(pk_algo,v.Public)
+	if err!=nil { return nil,err }
+	v.Plaintext = make([]byte,PlainSize)
+	io.ReadFull(rand,v.Plaintext)
+	
+	e := &ciphersuite2.EncryptionContext{PublicKey:pub,PK_Algo:pk_algo,Encoding:encoding,Random:rand}
+	buf := new(bytes.Buffer)
+	w,err := format2.NewWriter2(buf,e,&format2.WriterOptions{ChunkSize:ChunkSize,Random:rand})
+	if err!=nil { return nil,err }
+	_,err = w.Write(v.Plaintext)
+	if err==nil { err = w.Close() }
+	if err!=nil { return nil,err }
+	v.Ciphertext = buf.Bytes()
+	return v,nil
+}
+
+/*
+Generates the vectors for all combinations of the given PK_Algos and Encodings. If nil,
+all registered ones are used. Combinations, that can not be generated, are returned as failures.
+*/
+func GenerateAll(seed string,pk_algos,encodings []string) (vs []*Vector,fails []*Failure) {
+	if pk_algos==nil { pk_algos = ciphersuite2.PkAlgos() }
+	if encodings==nil { encodings = ciphersuite2.Ciphers() }
+	for _,pk := range pk_algos {
+		for _,enc := range encodings {
+			v,err := Generate(seed,pk,enc)
+			if err!=nil {
+				fails = append(fails,&Failure{pk,enc,err})
+				continue
+			}
+			vs = append(vs,v)
+		}
+	}
+	return
+}
+
+/*
+Decrypts a vector and compares the result with its plaintext.
+*/
+func Check(v *Vector) error {
+	priv,err := ciphersuite2.LoadPrivateKey(v.PK_Algo,v.Private)
+	if err!=nil { return err }
+	r,err := format2.NewReader(bytes.NewReader(v.Ciphertext),ciphersuite2.Decrypt(ciphersuite2.AsKeyRing(priv)))
+	if err!=nil { return err }
+	out,err := ioutil.ReadAll(r)
+	if err!=nil { return err }
+	if !bytes.Equal(out,v.Plaintext) { return EMismatch }
+	return nil
+}
+
+/*
+Reports, whether the generation of the combination is deterministic, by generating it twice.
+*/
+func Deterministic(seed,pk_algo,encoding string) (bool,error) {
+	a,err := Generate(seed,pk_algo,encoding)
+	if err!=nil { return false,err }
+	b,err := Generate(seed,pk_algo,encoding)
+	if err!=nil { return false,err }
+	return bytes.Equal(a.Ciphertext,b.Ciphertext) && bytes.Equal(a.Private,b.Private),nil
+}
+
+/*
+Checks a vector (see Check), and regenerates it from its seed. If the combination is
+deterministic, the keys and the ciphertext must be equal to the ones of the vector.
+*/
+func Compare(v *Vector) error {
+	err := Check(v)
+	if err!=nil { return err }
+	det,err := Deterministic(v.Seed,v.PK_Algo,v.Encoding)
+	if err!=nil || !det { return err }
+	n,err := Generate(v.Seed,v.PK_Algo,v.Encoding)
+	if err!=nil { return err }
+	if !bytes.Equal(n.Public,v.Public) || !bytes.Equal(n.Private,v.Private) || !bytes.Equal(n.Ciphertext,v.Ciphertext) { return EChanged }
+	return nil
+}
+
+/*
+Compares all vectors (see Compare) and returns every changed or failing combination.
+*/
+func CompareAll(vs []*Vector) (fails []*Failure) {
+	for _,v := range vs {
+		err := Compare(v)
+		if err!=nil { fails = append(fails,&Failure{v.PK_Algo,v.Encoding,err}) }
+	}
+	return
+}
+
+/*
+Returns the registered combinations of PK_Algo and Encoding, that have no vector.
+*/
+func Missing(vs []*Vector) (fails []*Failure) {
+	have := make(map[[2]string]bool)
+	for _,v := range vs { have[[2]string{v.PK_Algo,v.Encoding}] = true }
+	for _,pk := range ciphersuite2.PkAlgos() {
+		for _,enc := range ciphersuite2.Ciphers() {
+			if !have[[2]string{pk,enc}] { fails = append(fails,&Failure{pk,enc,ENoVector}) }
+		}
+	}
+	return
+}
+
+/*
+Like GenerateAll, but keeps the given vectors and only generates the combinations, that
+are missing (see Missing).
+*/
+func GenerateMissing(seed string,vs []*Vector) ([]*Vector,[]*Failure) {
+	var fails []*Failure
+	for _,m := range Missing(vs) {
+		v,err := Generate(seed,m.PK_Algo,m.Encoding)
+		if err!=nil {
+			fails = append(fails,&Failure{m.PK_Algo,m.Encoding,err})
+			continue
+		}
+		vs = append(vs,v)
+	}
+	return vs,fails
+}
+
+/*
+Checks all vectors and returns the failing combinations.
+*/
+func Verify(vs []*Vector) (fails []*Failure) {
+	for _,v := range vs {
+		err := Check(v)
+		if err!=nil { fails = append(fails,&Failure{v.PK_Algo,v.Encoding,err}) }
+	}
+	return
+}
+
+func Write(w io.Writer,vs []*Vector) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("","\t")
+	return enc.Encode(vs)
+}
+func Read(r io.Reader) (vs []*Vector,err error) {
+	err = json.NewDecoder(r).Decode(&vs)
+	return
+}
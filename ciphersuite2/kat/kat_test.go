@@ -0,0 +1,78 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package kat
+
+import (
+	"os"
+	"testing"
+	
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/aesmodes"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/aez"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/bcns"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/brainpool"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/camellia"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/chacha20poly1305"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/fipsecc"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/hs1siv"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/koblitz"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/koreancrypt"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/morus"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/newhope"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/pk25519"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/twofish"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/x448"
+)
+
+// The committed vectors (c2kat -gen vectors.json) must still decrypt, and the deterministic
+// ones must regenerate byte for byte. Every failing combination is reported.
+func TestVectors(t *testing.T) {
+	f,err := os.Open("vectors.json")
+	if err!=nil { t.Fatal(err) }
+	vs,err := Read(f)
+	f.Close()
+	if err!=nil { t.Fatal(err) }
+	if len(vs)==0 { t.Fatal("no vectors") }
+	for _,fl := range CompareAll(vs) { t.Error(fl) }
+}
+
+// Every registered combination must have a vector (c2kat -gen vectors.json -add).
+func TestCoverage(t *testing.T) {
+	f,err := os.Open("vectors.json")
+	if err!=nil { t.Fatal(err) }
+	vs,err := Read(f)
+	f.Close()
+	if err!=nil { t.Fatal(err) }
+	for _,fl := range Missing(vs) { t.Error(fl) }
+}
+
+// A changed ciphertext is detected.
+func TestVectorsTampered(t *testing.T) {
+	f,err := os.Open("vectors.json")
+	if err!=nil { t.Fatal(err) }
+	vs,err := Read(f)
+	f.Close()
+	if err!=nil { t.Fatal(err) }
+	v := vs[0]
+	v.Ciphertext[len(v.Ciphertext)/2] ^= 1
+	if Compare(v)==nil { t.Fatal("tampered vector accepted") }
+}
@@ -24,7 +24,7 @@ SOFTWARE.
 /*
 Bitelliptic implements several Koblitz
 
-	PK_Algo = (
+	PK_Algo, Sig_Algo = (
 		"koblitz_s160"
 		"koblitz_s192"
 		"koblitz_s224"
@@ -45,5 +45,10 @@ func init() {
 	ciphersuite2.RegisterPkAlgo("koblitz_s192",ecc.Wrap(elliptic.S192()))
 	ciphersuite2.RegisterPkAlgo("koblitz_s224",ecc.Wrap(elliptic.S224()))
 	ciphersuite2.RegisterPkAlgo("koblitz_s256",ecc.Wrap(elliptic.S256()))
+
+	ciphersuite2.RegisterSigAlgo("koblitz_s160",ecc.WrapSig(elliptic.S160()))
+	ciphersuite2.RegisterSigAlgo("koblitz_s192",ecc.WrapSig(elliptic.S192()))
+	ciphersuite2.RegisterSigAlgo("koblitz_s224",ecc.WrapSig(elliptic.S224()))
+	ciphersuite2.RegisterSigAlgo("koblitz_s256",ecc.WrapSig(elliptic.S256()))
 }
 
@@ -0,0 +1,182 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package ciphersuite2
+
+import (
+	"github.com/mad-day/cryptoinfra/format2"
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+)
+
+type NoRecipientError string
+func (e NoRecipientError) Error() string { return "No matching Recipient: "+string(e) }
+
+/*
+A public key of a recipient.
+*/
+type RecipientKey struct {
+	PublicKey PublicKey
+	PK_Algo   string
+}
+
+/*
+Encrypter for multiple recipients.
+
+A random content key is generated and wrapped for every recipient. The key encryption
+key is derived by the PK_Algo of the recipient, the wrapping is done with AES-256-GCM.
+The Key of a recipient stanza is the random nonce (12 bytes), followed by the sealed
+content key. So the wrapping stays safe, if a PK_Algo returns the same key encryption
+key more than once (a static or deterministic one).
+The stream is Wrapped (see format2.Preamble), so the recipients can be changed later
+with RewrapContext.
+*/
+type MultiEncryptionContext struct {
+	Recipients []RecipientKey
+	Encoding   string
+	Random     io.Reader
+	
+	// If set, the content key is stored into it.
+	Session    *SessionKey
+}
+
+const wrapNonceSize = 12
+
+func wrapCipher(kek *Cipher_Buffer) (cipher.AEAD,error) {
+	b,err := aes.NewCipher(kek.Key)
+	if err!=nil { return nil,err }
+	return cipher.NewGCM(b)
+}
+func newKek() *Cipher_Buffer { return &Cipher_Buffer{Key:make([]byte,32)} }
+
+func (e *MultiEncryptionContext) StartEncryption() (*format2.Preamble, *format2.CipherObject, error) {
+	enc,ok := cipher_drivers[e.Encoding]
+	if !ok { return nil,nil,UnknownCipherError(e.Encoding) }
+	
+	cb := enc.Keybuf()
+	content := make([]byte,len(cb.Key)+len(cb.IV))
+	_,err := io.ReadFull(e.Random,content)
+	if err!=nil { return nil,nil,err }
+	copy(cb.Key,content)
+	copy(cb.IV,content[len(cb.Key):])
+	if e.Session!=nil { e.Session.capture(e.Encoding,cb) }
+	
+	p,err := wrapKey(e.Random,e.Recipients,e.Encoding,content)
+	if err!=nil { return nil,nil,err }
+	
+	ciph,err := startCipher(enc,cb,true)
+	if err!=nil { return nil,nil,err }
+	return p,ciph,nil
+}
+
+/*
+Wraps the content key for every recipient into a Wrapped Preamble.
+*/
+func wrapKey(rand io.Reader,recipients []RecipientKey,encoding string,content []byte) (*format2.Preamble,error) {
+	p := &format2.Preamble{Encoding:encoding,Wrapped:true}
+	for _,rk := range recipients {
+		pka,ok := pka_drivers[rk.PK_Algo]
+		if !ok { return nil,UnknownPkaError(rk.PK_Algo) }
+		kek := newKek()
+		opaque,err := pka.EncryptKey(rand,rk.PublicKey,kek)
+		if err!=nil { return nil,err }
+		aead,err := wrapCipher(kek)
+		if err!=nil { return nil,err }
+		nonce := make([]byte,wrapNonceSize)
+		_,err = io.ReadFull(rand,nonce)
+		if err!=nil { return nil,err }
+		p.Recipients = append(p.Recipients,format2.Recipient{
+			PK_Algo:rk.PK_Algo,
+			Opaque:opaque,
+			Key:aead.Seal(nonce,nonce,content,[]byte(encoding)),
+		})
+	}
+	return p,nil
+}
+
+/*
+Tries the recipient stanzas against the Key-Ring, until one works.
+*/
+func (d *DecryptionContext) startMulti(p *format2.Preamble,enc Cipher_Driver) (*format2.CipherObject,error) {
+	cb,err := d.unwrapKey(p,enc)
+	if err!=nil { return nil,err }
+	return startCipher(enc,cb,false)
+}
+
+/*
+Unwraps the content key from the first recipient stanza, that matches the Key-Ring.
+Fails with NoRecipientError, if none does, or if there are no stanzas at all.
+*/
+func (d *DecryptionContext) unwrapKey(p *format2.Preamble,enc Cipher_Driver) (*Cipher_Buffer,error) {
+	var last error
+	for _,rc := range p.Recipients {
+		pka,ok := pka_drivers[rc.PK_Algo]
+		if !ok { last = UnknownPkaError(rc.PK_Algo); continue }
+		opaque,prik,err := d.getKey2(rc.Opaque,rc.PK_Algo)
+		if err!=nil { last = err; continue }
+		kek := newKek()
+		err = pka.DecryptKey(opaque,prik,kek)
+		if err!=nil { last = err; continue }
+		aead,err := wrapCipher(kek)
+		if err!=nil { last = err; continue }
+		if len(rc.Key)<wrapNonceSize { last = MalformedEncryptedKeyError("stanza too short"); continue }
+		content,err := aead.Open(nil,rc.Key[:wrapNonceSize],rc.Key[wrapNonceSize:],[]byte(p.Encoding))
+		if err!=nil { last = err; continue }
+		cb := enc.Keybuf()
+		if len(content)!=len(cb.Key)+len(cb.IV) { last = MalformedEncryptedKeyError("content key size"); continue }
+		copy(cb.Key,content)
+		copy(cb.IV,content[len(cb.Key):])
+		return cb,nil
+	}
+	if last==nil { return nil,NoRecipientError("no recipient stanzas") }
+	return nil,NoRecipientError(last.Error())
+}
+
+/*
+Rewrapper for format2.Rewrap: unwraps the content key of a Wrapped stream with From,
+and wraps it for the new Recipients. Only the Preamble is replaced, the content key and
+the ciphertext stay the same.
+*/
+type RewrapContext struct {
+	From       *DecryptionContext
+	Recipients []RecipientKey
+	Random     io.Reader
+}
+func (r *RewrapContext) Rewrap(p *format2.Preamble) (*format2.Preamble,error) {
+	enc,ok := cipher_drivers[p.Encoding]
+	if !ok { return nil,UnknownCipherError(p.Encoding) }
+	cb,err := r.From.unwrapKey(p,enc)
+	if err!=nil { return nil,err }
+	content := append(append([]byte(nil),cb.Key...),cb.IV...)
+	defer func() { for i := range content { content[i] = 0 } }()
+	return wrapKey(r.Random,r.Recipients,p.Encoding,content)
+}
+
+/*
+Rewraps the stream in src for the given recipients, and writes it to dst. from recovers
+the content key, for instance with the old private key. See format2.Rewrap.
+*/
+func Rewrap(dst io.Writer,src io.Reader,from *DecryptionContext,to []RecipientKey,rand io.Reader) (int64,error) {
+	return format2.Rewrap(dst,src,&RewrapContext{From:from,Recipients:to,Random:rand},nil)
+}
@@ -0,0 +1,165 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package ciphersuite2_test
+
+import (
+	"github.com/mad-day/cryptoinfra/ciphersuite2"
+	"github.com/mad-day/cryptoinfra/format2"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/aesmodes"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/pk25519"
+)
+
+const testEncoding = "aes-256/gcm"
+
+func recipient(t *testing.T) (ciphersuite2.RecipientKey,*ciphersuite2.DecryptionContext) {
+	t.Helper()
+	pub,priv,err := ciphersuite2.GenerateKeyPair(rand.Reader,"curve25519")
+	if err!=nil { t.Fatal(err) }
+	pk,err := ciphersuite2.LoadPublicKey("curve25519",pub)
+	if err!=nil { t.Fatal(err) }
+	sk,err := ciphersuite2.LoadPrivateKey("curve25519",priv)
+	if err!=nil { t.Fatal(err) }
+	return ciphersuite2.RecipientKey{PublicKey:pk,PK_Algo:"curve25519"},ciphersuite2.Decrypt(ciphersuite2.AsKeyRing(sk))
+}
+
+func encrypt(t *testing.T,to []ciphersuite2.RecipientKey,data []byte) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	w,err := format2.NewWriter(buf,&ciphersuite2.MultiEncryptionContext{Recipients:to,Encoding:testEncoding,Random:rand.Reader})
+	if err!=nil { t.Fatal(err) }
+	_,err = w.Write(data)
+	if err==nil { err = w.Close() }
+	if err!=nil { t.Fatal(err) }
+	return buf.Bytes()
+}
+
+func decrypt(ct []byte,d format2.Decrypter) ([]byte,error) {
+	r,err := format2.NewReader(bytes.NewReader(ct),d)
+	if err!=nil { return nil,err }
+	return ioutil.ReadAll(r)
+}
+
+func expectNoRecipient(t *testing.T,ct []byte,d format2.Decrypter) {
+	t.Helper()
+	_,err := decrypt(ct,d)
+	var nr ciphersuite2.NoRecipientError
+	if !errors.As(err,&nr) { t.Fatalf("got %v, want NoRecipientError",err) }
+}
+
+func TestRecipients(t *testing.T) {
+	a,da := recipient(t)
+	b,db := recipient(t)
+	_,dc := recipient(t)
+	data := []byte("for a and b")
+	ct := encrypt(t,[]ciphersuite2.RecipientKey{a,b},data)
+	for _,d := range []*ciphersuite2.DecryptionContext{da,db} {
+		pt,err := decrypt(ct,d)
+		if err!=nil || !bytes.Equal(pt,data) { t.Fatalf("got %q, %v",pt,err) }
+	}
+	expectNoRecipient(t,ct,dc)
+}
+
+// Rewrapping for b removes a, the content key stays the same.
+func TestRewrap(t *testing.T) {
+	a,da := recipient(t)
+	b,db := recipient(t)
+	data := []byte("moved from a to b")
+	ct := encrypt(t,[]ciphersuite2.RecipientKey{a},data)
+	buf := new(bytes.Buffer)
+	_,err := ciphersuite2.Rewrap(buf,bytes.NewReader(ct),da,[]ciphersuite2.RecipientKey{b},rand.Reader)
+	if err!=nil { t.Fatal(err) }
+	pt,err := decrypt(buf.Bytes(),db)
+	if err!=nil || !bytes.Equal(pt,data) { t.Fatalf("got %q, %v",pt,err) }
+	expectNoRecipient(t,buf.Bytes(),da)
+	
+	// Only the owner of the old key can rewrap.
+	_,err = ciphersuite2.Rewrap(new(bytes.Buffer),bytes.NewReader(buf.Bytes()),da,[]ciphersuite2.RecipientKey{a},rand.Reader)
+	var nr ciphersuite2.NoRecipientError
+	if !errors.As(err,&nr) { t.Fatalf("rewrap with a removed key: got %v",err) }
+}
+
+// Flips a bit in the wrapped key of the first stanza.
+type tamper struct{}
+func (tamper) Rewrap(p *format2.Preamble) (*format2.Preamble,error) {
+	q := *p
+	q.Recipients = append([]format2.Recipient(nil),p.Recipients...)
+	q.Recipients[0].Key = append([]byte(nil),q.Recipients[0].Key...)
+	q.Recipients[0].Key[len(q.Recipients[0].Key)-1] ^= 1
+	return &q,nil
+}
+
+func TestTamperedStanza(t *testing.T) {
+	a,da := recipient(t)
+	ct := encrypt(t,[]ciphersuite2.RecipientKey{a},[]byte("data"))
+	buf := new(bytes.Buffer)
+	_,err := format2.Rewrap(buf,bytes.NewReader(ct),tamper{},nil)
+	if err!=nil { t.Fatal(err) }
+	expectNoRecipient(t,buf.Bytes(),da)
+}
+
+/*
+A PK_Algo, that returns the same key encryption key every time. The wrapping must not
+reuse its nonce anyway.
+*/
+type staticPka struct{}
+func (staticPka) GenerateKeyPair(rand io.Reader) (pub,priv []byte,err error) { return []byte{0},[]byte{0},nil }
+func (staticPka) LoadPublic(pub []byte) (ciphersuite2.PublicKey,error) { return pub,nil }
+func (staticPka) LoadPrivate(priv []byte) (ciphersuite2.PrivateKey,error) { return priv,nil }
+func (staticPka) DecryptKey(opaque []byte,prik ciphersuite2.PrivateKey,cb *ciphersuite2.Cipher_Buffer) error {
+	for i := range cb.Key { cb.Key[i] = 7 }
+	return nil
+}
+func (staticPka) EncryptKey(rand io.Reader,pubk ciphersuite2.PublicKey,cb *ciphersuite2.Cipher_Buffer) ([]byte,error) {
+	for i := range cb.Key { cb.Key[i] = 7 }
+	return []byte("static"),nil
+}
+
+// Records the Preamble, without changing it.
+type peek struct{ p *format2.Preamble }
+func (k *peek) Rewrap(p *format2.Preamble) (*format2.Preamble,error) { k.p = p; return p,nil }
+
+func TestStaticKek(t *testing.T) {
+	ciphersuite2.RegisterPkAlgo("test-static",staticPka{})
+	rk := ciphersuite2.RecipientKey{PK_Algo:"test-static"}
+	d := ciphersuite2.Decrypt(ciphersuite2.AsKeyRing(nil))
+	seen := make(map[string]bool)
+	for i := 0; i<4; i++ {
+		data := []byte{byte(i)}
+		ct := encrypt(t,[]ciphersuite2.RecipientKey{rk},data)
+		pt,err := decrypt(ct,d)
+		if err!=nil || !bytes.Equal(pt,data) { t.Fatalf("got %q, %v",pt,err) }
+		k := new(peek)
+		_,err = format2.Rewrap(ioutil.Discard,bytes.NewReader(ct),k,nil)
+		if err!=nil { t.Fatal(err) }
+		nonce := string(k.p.Recipients[0].Key[:12])
+		if seen[nonce] { t.Fatal("wrap nonce reused") }
+		seen[nonce] = true
+	}
+}
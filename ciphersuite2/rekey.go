@@ -0,0 +1,60 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package ciphersuite2
+
+import (
+	"github.com/mad-day/cryptoinfra/format2"
+	"golang.org/x/crypto/hkdf"
+	"crypto/sha256"
+	"io"
+)
+
+var epochInfo = []byte("ciphersuite2 key epoch")
+
+/*
+Instantiates the driver with the key from cb and enables rekeying (see format2.CipherObject.Next).
+
+The Key and IV of the next key epoch are derived from the current ones with HKDF-SHA256
+(the Key being the secret, the IV the salt). The salt of an appended epoch is appended to
+the info string.
+*/
+func startCipher(enc Cipher_Driver,cb *Cipher_Buffer,en bool) (obj *format2.CipherObject,err error) {
+	cur := &Cipher_Buffer{Key:append([]byte(nil),cb.Key...),IV:append([]byte(nil),cb.IV...)}
+	if en {
+		obj,err = enc.Encrypt(cb)
+	} else {
+		obj,err = enc.Decrypt(cb)
+	}
+	if err!=nil { return nil,err }
+	obj.Next = func(salt []byte) (*format2.CipherObject,error) {
+		next := &Cipher_Buffer{Key:make([]byte,len(cur.Key)),IV:make([]byte,len(cur.IV))}
+		info := append(append([]byte(nil),epochInfo...),salt...)
+		kdf := hkdf.New(sha256.New,cur.Key,cur.IV,info)
+		_,err := io.ReadFull(kdf,next.Key)
+		if err!=nil { return nil,err }
+		_,err = io.ReadFull(kdf,next.IV)
+		if err!=nil { return nil,err }
+		return startCipher(enc,next,en)
+	}
+	return
+}
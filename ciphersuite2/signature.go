@@ -0,0 +1,72 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package ciphersuite2
+
+import (
+	"github.com/mad-day/cryptoinfra/format2"
+	"io"
+)
+
+var sig_drivers = make(map[string]Sig_Driver)
+
+/*
+A signature algorithm. Keys are passed in their serialized form.
+*/
+type Sig_Driver interface {
+	GenerateKeyPair(rand io.Reader) (pub,priv []byte,err error)
+	
+	Sign(rand io.Reader,priv []byte,digest []byte) (sig []byte,err error)
+	Verify(pub,digest,sig []byte) bool
+}
+
+/*
+Registers a signature algorithm. It is registered with format2.RegisterVerifier as well,
+so format2.Reader can verify signed streams.
+*/
+func RegisterSigAlgo(str string,sig Sig_Driver) {
+	sig_drivers[str] = sig
+	format2.RegisterVerifier(str,sig.Verify)
+}
+
+func GenerateSigningKeyPair(rand io.Reader,sig_algo string) (pub, priv []byte, err error) {
+	sig,ok := sig_drivers[sig_algo]
+	if !ok { return nil,nil,UnknownPkaError(sig_algo) }
+	
+	return sig.GenerateKeyPair(rand)
+}
+
+/* Signer for format2.WriterOptions. */
+type SigningContext struct {
+	PublicKey  []byte
+	PrivateKey []byte
+	Sig_Algo   string
+	Random     io.Reader
+}
+func (s *SigningContext) SignatureAlgo() string { return s.Sig_Algo }
+func (s *SigningContext) SignerKey() []byte { return s.PublicKey }
+func (s *SigningContext) Sign(digest []byte) ([]byte,error) {
+	sig,ok := sig_drivers[s.Sig_Algo]
+	if !ok { return nil,UnknownPkaError(s.Sig_Algo) }
+	return sig.Sign(s.Random,s.PrivateKey,digest)
+}
@@ -0,0 +1,101 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package ciphersuite2_test
+
+import (
+	"github.com/mad-day/cryptoinfra/ciphersuite2"
+	"github.com/mad-day/cryptoinfra/format2"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"testing"
+	
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/aesmodes"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/ed25519"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/fipsecc"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/pk25519"
+)
+
+func signedStream(t *testing.T,enc format2.Encrypter,signer format2.Signer,data []byte) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	w,err := format2.NewWriter2(buf,enc,&format2.WriterOptions{ChunkSize:1024,Signer:signer})
+	if err!=nil { t.Fatal(err) }
+	_,err = w.Write(data)
+	if err==nil { err = w.Close() }
+	if err!=nil { t.Fatal(err) }
+	return buf.Bytes()
+}
+
+// Returns the plaintext, the signer and the error of the Reader.
+func verifyStream(ct []byte,d format2.Decrypter,require bool) ([]byte,string,[]byte,error) {
+	r,err := format2.NewReader2(bytes.NewReader(ct),d,&format2.ReaderOptions{RequireSignature:require})
+	if err!=nil { return nil,"",nil,err }
+	pt,err := ioutil.ReadAll(r)
+	algo,pub := r.(*format2.Reader).Signer()
+	return pt,algo,pub,err
+}
+
+func TestSignature(t *testing.T) {
+	pub,priv,err := ciphersuite2.GenerateKeyPair(rand.Reader,"curve25519")
+	if err!=nil { t.Fatal(err) }
+	pk,err := ciphersuite2.LoadPublicKey("curve25519",pub)
+	if err!=nil { t.Fatal(err) }
+	sk,err := ciphersuite2.LoadPrivateKey("curve25519",priv)
+	if err!=nil { t.Fatal(err) }
+	enc := &ciphersuite2.EncryptionContext{PublicKey:pk,PK_Algo:"curve25519",Encoding:"aes-256/gcm",Random:rand.Reader}
+	dec := ciphersuite2.Decrypt(ciphersuite2.AsKeyRing(sk))
+	data := make([]byte,3000)
+	rand.Read(data)
+	
+	for _,algo := range []string{"ed25519","fips_p256","fips_p384"} {
+		spub,spriv,err := ciphersuite2.GenerateSigningKeyPair(rand.Reader,algo)
+		if err!=nil { t.Fatal(err) }
+		_,other,err := ciphersuite2.GenerateSigningKeyPair(rand.Reader,algo)
+		if err!=nil { t.Fatal(err) }
+		ct := signedStream(t,enc,&ciphersuite2.SigningContext{PublicKey:spub,PrivateKey:spriv,Sig_Algo:algo,Random:rand.Reader},data)
+		pt,salgo,spk,err := verifyStream(ct,dec,true)
+		if err!=nil || !bytes.Equal(pt,data) { t.Fatalf("%s: %v",algo,err) }
+		if salgo!=algo || !bytes.Equal(spk,spub) { t.Errorf("%s: Signer returned %q, %x",algo,salgo,spk) }
+		
+		// Signed with a key, that doesn't match the one in the Header.
+		forged := signedStream(t,enc,&ciphersuite2.SigningContext{PublicKey:spub,PrivateKey:other,Sig_Algo:algo,Random:rand.Reader},data)
+		flipped := append([]byte(nil),ct...)
+		flipped[len(flipped)-1] ^= 1
+		for name,c := range map[string][]byte{"forged":forged,"flipped":flipped,"cut":ct[:len(ct)-1]} {
+			pt,salgo,_,err = verifyStream(c,dec,false)
+			if !errors.Is(err,format2.ESignature) { t.Errorf("%s, %s: got %v, want ESignature",algo,name,err) }
+			// The final chunk is withheld.
+			if len(pt)>=len(data) || !bytes.Equal(pt,data[:len(pt)]) { t.Errorf("%s, %s: got %d bytes",algo,name,len(pt)) }
+			if salgo!="" { t.Errorf("%s, %s: Signer returned %q",algo,name,salgo) }
+		}
+	}
+	
+	ct := signedStream(t,enc,nil,data)
+	pt,salgo,_,err := verifyStream(ct,dec,false)
+	if err!=nil || !bytes.Equal(pt,data) || salgo!="" { t.Fatalf("unsigned: %q, %v",salgo,err) }
+	_,_,_,err = verifyStream(ct,dec,true)
+	if !errors.Is(err,format2.ENotSigned) { t.Errorf("unsigned: got %v, want ENotSigned",err) }
+}
@@ -0,0 +1,517 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+An encrypted and mutually authenticated net.Conn, built on ciphersuite2.
+
+Both peers hold a static key pair of the same PK_Algo. The client has to know the
+public key of the server in advance, the server decides on the client with Config.VerifyPeer.
+
+Handshake:
+
+	client -> server: clientHello (static and ephemeral public key, encapsulation to the server's static key)
+	server -> client: serverHello (encapsulations to the client's static and ephemeral key), Finished
+	client -> server: Finished
+
+The traffic secrets are derived with HKDF-SHA256 from the three shared secrets, salted with
+the hash of both hellos. Only the server can recover the first secret and only the client
+the second one, so the Finished records authenticate both peers. The ephemeral key
+provides forward secrecy.
+
+Records:
+
+	[1 byte ] type
+	[2 bytes] length of the ciphertext (big endian)
+	[n bytes] ciphertext, sealed with the Encoding (an AEAD), the first three bytes as associated data
+
+The nonce is the record counter (big endian, zero-padded to the nonce size). Every
+direction has its own key, that is ratcheted forward by a key update record.
+*/
+package tunnel
+
+import (
+	"github.com/mad-day/cryptoinfra/ciphersuite2"
+	"github.com/vmihailenco/msgpack"
+	"golang.org/x/crypto/hkdf"
+	
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	EHandshake = fmt.Errorf("Handshake Failed: wrong key or tampered handshake")
+	EAuthError = fmt.Errorf("Record Authentication Failed")
+	ENotAEAD = fmt.Errorf("Encoding is not an AEAD")
+	EUnexpected = fmt.Errorf("Unexpected Record")
+	EWriteClosed = fmt.Errorf("Write half is closed")
+	ETruncated = fmt.Errorf("Connection closed without close notification")
+	ENoPeerKey = fmt.Errorf("Config.PeerKey (client) or Config.VerifyPeer (server) is required")
+)
+
+type HandshakeError string
+func (e HandshakeError) Error() string { return "Handshake rejected: "+string(e) }
+
+const (
+	DefaultRekeyAfter = 1<<20
+	
+	// The longest time, Close waits to send the close notification.
+	CloseTimeout = 5*time.Second
+	
+	version = 1
+	maxHello = 1<<20
+	maxPlain = 16<<10
+	headerSize = 3
+	secretSize = 32
+)
+
+// Record types.
+const (
+	recData byte = iota
+	recFinished
+	recUpdate
+	recClose
+)
+
+type Config struct {
+	// The static key pair of this peer. PrivateKey is loaded by ciphersuite2.LoadPrivateKey.
+	PK_Algo    string
+	PublicKey  []byte
+	PrivateKey ciphersuite2.PrivateKey
+	
+	// The Encoding of the records, it has to be an AEAD. The server rejects a client with a different one.
+	Encoding string
+	
+	// Client only: The static public key of the server.
+	PeerKey []byte
+	
+	// Server only: Decides, whether a client with the static public key pub is accepted.
+	VerifyPeer func(pk_algo string,pub []byte) error
+	
+	// The number of records, after which the sending key is updated. Defaults to DefaultRekeyAfter.
+	RekeyAfter uint64
+	
+	// Defaults to crypto/rand.Reader.
+	Random io.Reader
+}
+func (c *Config) random() io.Reader {
+	if c.Random==nil { return rand.Reader }
+	return c.Random
+}
+func (c *Config) rekeyAfter() uint64 {
+	if c.RekeyAfter==0 { return DefaultRekeyAfter }
+	return c.RekeyAfter
+}
+
+type clientHello struct {
+	_msgpack struct{} `msgpack:",asArray"`
+	Version   int
+	PK_Algo   string
+	Encoding  string
+	Static    []byte // The static public key of the client.
+	Ephemeral []byte
+	Opaque    []byte // Encapsulation to the static key of the server.
+	Nonce     []byte
+}
+type serverHello struct {
+	_msgpack struct{} `msgpack:",asArray"`
+	Static    []byte // Encapsulation to the static key of the client.
+	Ephemeral []byte // Encapsulation to the ephemeral key of the client.
+	Nonce     []byte
+}
+
+// One direction of the connection.
+type half struct {
+	sync.Mutex
+	encoding string
+	decrypt  bool
+	aead   cipher.AEAD
+	secret []byte
+	seq    uint64
+	nonce  []byte
+	buf    []byte // The raw record.
+	have   int    // Reading: The amount of the raw record received.
+	plain  []byte
+	data   []byte // Reading: Plaintext, that has not been returned yet.
+	err    error  // Sticky error.
+	closed bool   // Writing: the close notification has been sent. Reading: it has been received.
+}
+func expand(secret []byte,info string,out []byte) {
+	io.ReadFull(hkdf.Expand(sha256.New,secret,[]byte(info)),out)
+}
+func (h *half) setKey(secret []byte) error {
+	h.secret,h.seq = secret,0
+	cb,err := ciphersuite2.Keybuf(h.encoding)
+	if err!=nil { return err }
+	expand(secret,"tunnel key",cb.Key)
+	expand(secret,"tunnel iv",cb.IV)
+	newc := ciphersuite2.NewCipher
+	if h.decrypt { newc = ciphersuite2.NewDecipher }
+	c,err := newc(h.encoding,cb)
+	if err!=nil { return err }
+	if c.AEAD==nil || c.AEAD.NonceSize()<8 { return ENotAEAD }
+	h.aead = c.AEAD
+	h.nonce = make([]byte,c.AEAD.NonceSize())
+	return nil
+}
+func (h *half) update() error {
+	next := make([]byte,secretSize)
+	expand(h.secret,"tunnel update",next)
+	return h.setKey(next)
+}
+func (h *half) next() []byte {
+	binary.BigEndian.PutUint64(h.nonce[len(h.nonce)-8:],h.seq)
+	return h.nonce
+}
+
+/*
+An encrypted net.Conn. The handshake is run by the first Read or Write, or by Handshake.
+
+Read and Write may be called concurrently. After a Write failed (including timeouts),
+the connection is unusable. Read timeouts can be retried.
+*/
+type Conn struct {
+	conn   net.Conn
+	cfg    *Config
+	client bool
+	r      *bufio.Reader
+	
+	hsMu   sync.Mutex
+	hsDone bool
+	hsErr  error
+	hsOK   int32 // Set, once the handshake succeeded. Read by Close without c.hsMu.
+	peer   []byte
+	
+	in  half
+	out half
+}
+
+// Wraps the client side of conn.
+func Client(conn net.Conn,cfg *Config) *Conn {
+	return &Conn{conn:conn,cfg:cfg,client:true,r:bufio.NewReader(conn)}
+}
+
+// Wraps the server side of conn.
+func Server(conn net.Conn,cfg *Config) *Conn {
+	return &Conn{conn:conn,cfg:cfg,r:bufio.NewReader(conn)}
+}
+
+func (c *Conn) Handshake() error {
+	c.hsMu.Lock(); defer c.hsMu.Unlock()
+	if c.hsDone { return c.hsErr }
+	c.in.Lock(); defer c.in.Unlock()
+	c.out.Lock(); defer c.out.Unlock()
+	c.in.encoding,c.out.encoding,c.in.decrypt = c.cfg.Encoding,c.cfg.Encoding,true
+	if c.client {
+		c.hsErr = c.clientHandshake()
+	} else {
+		c.hsErr = c.serverHandshake()
+	}
+	if c.hsErr==EAuthError || c.hsErr==EUnexpected { c.hsErr = EHandshake }
+	if c.hsErr!=nil {
+		c.in.err,c.out.err = c.hsErr,c.hsErr
+	} else {
+		atomic.StoreInt32(&c.hsOK,1)
+	}
+	c.hsDone = true
+	return c.hsErr
+}
+
+// Returns the static public key of the peer, once the handshake is completed.
+func (c *Conn) PeerKey() []byte {
+	c.hsMu.Lock(); defer c.hsMu.Unlock()
+	if !c.hsDone || c.hsErr!=nil { return nil }
+	return c.peer
+}
+
+func (c *Conn) writeHello(v interface{}) ([]byte,error) {
+	body,err := msgpack.Marshal(v)
+	if err!=nil { return nil,err }
+	frame := make([]byte,4,4+len(body))
+	binary.BigEndian.PutUint32(frame,uint32(len(body)))
+	_,err = c.conn.Write(append(frame,body...))
+	return body,err
+}
+func (c *Conn) readHello(v interface{}) ([]byte,error) {
+	var l [4]byte
+	_,err := io.ReadFull(c.r,l[:])
+	if err!=nil { return nil,err }
+	n := binary.BigEndian.Uint32(l[:])
+	if n>maxHello { return nil,HandshakeError("oversized hello") }
+	body := make([]byte,n)
+	_,err = io.ReadFull(c.r,body)
+	if err!=nil { return nil,err }
+	return body,msgpack.Unmarshal(body,v)
+}
+
+func newSecret() *ciphersuite2.Cipher_Buffer { return &ciphersuite2.Cipher_Buffer{Key:make([]byte,secretSize)} }
+
+// Derives the traffic secrets from the hellos and the shared secrets.
+func (c *Conn) deriveKeys(ch,sh []byte,secrets ...*ciphersuite2.Cipher_Buffer) error {
+	t := sha256.New()
+	var l [4]byte
+	for _,b := range [][]byte{ch,sh} {
+		binary.BigEndian.PutUint32(l[:],uint32(len(b)))
+		t.Write(l[:])
+		t.Write(b)
+	}
+	var ikm []byte
+	for _,s := range secrets { ikm = append(ikm,s.Key...) }
+	prk := hkdf.Extract(sha256.New,ikm,t.Sum(nil))
+	cs,sc := make([]byte,secretSize),make([]byte,secretSize)
+	expand(prk,"tunnel client",cs)
+	expand(prk,"tunnel server",sc)
+	if !c.client { cs,sc = sc,cs }
+	err := c.out.setKey(cs)
+	if err!=nil { return err }
+	return c.in.setKey(sc)
+}
+
+func (c *Conn) clientHandshake() error {
+	cfg := c.cfg
+	if cfg.PeerKey==nil { return ENoPeerKey }
+	rnd := cfg.random()
+	spub,err := ciphersuite2.LoadPublicKey(cfg.PK_Algo,cfg.PeerKey)
+	if err!=nil { return err }
+	epub,epriv,err := ciphersuite2.GenerateKeyPair(rnd,cfg.PK_Algo)
+	if err!=nil { return err }
+	eprik,err := ciphersuite2.LoadPrivateKey(cfg.PK_Algo,epriv)
+	if err!=nil { return err }
+	s1,s2,s3 := newSecret(),newSecret(),newSecret()
+	hello := &clientHello{Version:version,PK_Algo:cfg.PK_Algo,Encoding:cfg.Encoding,Static:cfg.PublicKey,Ephemeral:epub,Nonce:make([]byte,32)}
+	hello.Opaque,err = ciphersuite2.EncryptKey(rnd,cfg.PK_Algo,spub,s1)
+	if err!=nil { return err }
+	_,err = io.ReadFull(rnd,hello.Nonce)
+	if err!=nil { return err }
+	ch,err := c.writeHello(hello)
+	if err!=nil { return err }
+	reply := new(serverHello)
+	sh,err := c.readHello(reply)
+	if err!=nil { return err }
+	err = ciphersuite2.DecryptKey(cfg.PK_Algo,reply.Static,cfg.PrivateKey,s2)
+	if err!=nil { return err }
+	err = ciphersuite2.DecryptKey(cfg.PK_Algo,reply.Ephemeral,eprik,s3)
+	if err!=nil { return err }
+	err = c.deriveKeys(ch,sh,s1,s2,s3)
+	if err!=nil { return err }
+	typ,plain,err := c.readRecord()
+	if err!=nil { return err }
+	if typ!=recFinished || len(plain)!=0 { return EUnexpected }
+	c.peer = cfg.PeerKey
+	return c.writeRecord(recFinished,nil)
+}
+
+func (c *Conn) serverHandshake() error {
+	cfg := c.cfg
+	if cfg.VerifyPeer==nil { return ENoPeerKey }
+	rnd := cfg.random()
+	hello := new(clientHello)
+	ch,err := c.readHello(hello)
+	if err!=nil { return err }
+	if hello.Version!=version { return HandshakeError("unsupported version") }
+	if hello.PK_Algo!=cfg.PK_Algo { return HandshakeError("PK_Algo mismatch") }
+	if hello.Encoding!=cfg.Encoding { return HandshakeError("Encoding mismatch") }
+	err = cfg.VerifyPeer(hello.PK_Algo,hello.Static)
+	if err!=nil { return err }
+	s1,s2,s3 := newSecret(),newSecret(),newSecret()
+	err = ciphersuite2.DecryptKey(cfg.PK_Algo,hello.Opaque,cfg.PrivateKey,s1)
+	if err!=nil { return err }
+	cpub,err := ciphersuite2.LoadPublicKey(cfg.PK_Algo,hello.Static)
+	if err!=nil { return err }
+	epub,err := ciphersuite2.LoadPublicKey(cfg.PK_Algo,hello.Ephemeral)
+	if err!=nil { return err }
+	reply := &serverHello{Nonce:make([]byte,32)}
+	reply.Static,err = ciphersuite2.EncryptKey(rnd,cfg.PK_Algo,cpub,s2)
+	if err!=nil { return err }
+	reply.Ephemeral,err = ciphersuite2.EncryptKey(rnd,cfg.PK_Algo,epub,s3)
+	if err!=nil { return err }
+	_,err = io.ReadFull(rnd,reply.Nonce)
+	if err!=nil { return err }
+	sh,err := c.writeHello(reply)
+	if err!=nil { return err }
+	err = c.deriveKeys(ch,sh,s1,s2,s3)
+	if err!=nil { return err }
+	err = c.writeRecord(recFinished,nil)
+	if err!=nil { return err }
+	typ,plain,err := c.readRecord()
+	if err!=nil { return err }
+	if typ!=recFinished || len(plain)!=0 { return EUnexpected }
+	c.peer = hello.Static
+	return nil
+}
+
+// Seals and sends a record. The caller holds c.out.
+func (c *Conn) writeRecord(typ byte,p []byte) error {
+	o := &c.out
+	if o.err!=nil { return o.err }
+	var hdr [headerSize]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint16(hdr[1:],uint16(len(p)+o.aead.Overhead()))
+	o.buf = o.aead.Seal(append(o.buf[:0],hdr[:]...),o.next(),p,hdr[:])
+	_,err := c.conn.Write(o.buf)
+	if err!=nil { o.err = err; return err }
+	o.seq++
+	if typ==recUpdate {
+		err = o.update()
+		if err!=nil { o.err = err }
+	}
+	return err
+}
+
+// Reads until the raw record has n bytes. Partial records survive timeouts.
+func (c *Conn) fill(n int) error {
+	i := &c.in
+	if len(i.buf)<n { i.buf = append(i.buf,make([]byte,n-len(i.buf))...) }
+	for i.have<n {
+		m,err := c.r.Read(i.buf[i.have:n])
+		i.have += m
+		if err==io.EOF || err==io.ErrUnexpectedEOF { i.err = ETruncated; return i.err }
+		if ne,ok := err.(net.Error); ok && ne.Timeout() { return err }
+		if err!=nil { i.err = err; return err }
+	}
+	return nil
+}
+
+// Receives and opens a record. The caller holds c.in.
+func (c *Conn) readRecord() (byte,[]byte,error) {
+	i := &c.in
+	if i.err!=nil { return 0,nil,i.err }
+	err := c.fill(headerSize)
+	if err!=nil { return 0,nil,err }
+	n := int(binary.BigEndian.Uint16(i.buf[1:]))
+	err = c.fill(headerSize+n)
+	if err!=nil { return 0,nil,err }
+	i.have = 0
+	typ := i.buf[0]
+	i.plain,err = i.aead.Open(i.plain[:0],i.next(),i.buf[headerSize:headerSize+n],i.buf[:headerSize])
+	if err!=nil { i.err = EAuthError; return 0,nil,i.err }
+	i.seq++
+	return typ,i.plain,nil
+}
+
+func (c *Conn) Read(p []byte) (int,error) {
+	err := c.Handshake()
+	if err!=nil { return 0,err }
+	i := &c.in
+	i.Lock(); defer i.Unlock()
+	for len(i.data)==0 {
+		if i.closed { return 0,io.EOF }
+		typ,plain,err := c.readRecord()
+		if err!=nil { return 0,err }
+		switch {
+		case typ==recData: i.data = plain
+		case typ==recUpdate && len(plain)==0:
+			err = i.update()
+			if err!=nil { i.err = err; return 0,err }
+		case typ==recClose && len(plain)==0: i.closed = true
+		default:
+			i.err = EUnexpected
+			return 0,i.err
+		}
+	}
+	n := copy(p,i.data)
+	i.data = i.data[n:]
+	return n,nil
+}
+
+func (c *Conn) Write(p []byte) (n int,err error) {
+	err = c.Handshake()
+	if err!=nil { return 0,err }
+	o := &c.out
+	o.Lock(); defer o.Unlock()
+	if o.closed { return 0,EWriteClosed }
+	for len(p)>0 {
+		if o.seq>=c.cfg.rekeyAfter() {
+			err = c.writeRecord(recUpdate,nil)
+			if err!=nil { return }
+		}
+		m := len(p)
+		if m>maxPlain { m = maxPlain }
+		err = c.writeRecord(recData,p[:m])
+		if err!=nil { return }
+		n += m
+		p = p[m:]
+	}
+	return
+}
+
+// Updates the sending key. The peer follows, when it reads the key update record.
+func (c *Conn) Rekey() error {
+	err := c.Handshake()
+	if err!=nil { return err }
+	c.out.Lock(); defer c.out.Unlock()
+	if c.out.closed { return EWriteClosed }
+	return c.writeRecord(recUpdate,nil)
+}
+
+/*
+Sends the close notification and shuts down the writing side of the underlying
+connection, if it supports that (like *net.TCPConn). The peer's Read returns io.EOF.
+Reading is still possible.
+*/
+func (c *Conn) CloseWrite() error {
+	err := c.Handshake()
+	if err!=nil { return err }
+	c.out.Lock(); defer c.out.Unlock()
+	if c.out.closed { return nil }
+	err = c.writeRecord(recClose,nil)
+	if err!=nil { return err }
+	c.out.closed = true
+	if cw,ok := c.conn.(interface{ CloseWrite() error }); ok { return cw.CloseWrite() }
+	return nil
+}
+
+/*
+Sends the close notification (unless a Write is pending or the handshake has not been
+completed) and closes the underlying connection.
+
+If the peer doesn't read, and the send buffer of the underlying connection is full,
+sending the close notification blocks Close for up to CloseTimeout. The notification
+is lost then, and the peer's Read fails with ETruncated.
+*/
+func (c *Conn) Close() error {
+	if atomic.LoadInt32(&c.hsOK)==1 && c.out.TryLock() {
+		if !c.out.closed {
+			c.conn.SetWriteDeadline(time.Now().Add(CloseTimeout))
+			c.writeRecord(recClose,nil)
+			c.out.closed = true
+		}
+		c.out.Unlock()
+	}
+	return c.conn.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+func (c *Conn) SetDeadline(t time.Time) error { return c.conn.SetDeadline(t) }
+func (c *Conn) SetReadDeadline(t time.Time) error { return c.conn.SetReadDeadline(t) }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+var _ net.Conn = (*Conn)(nil)
@@ -0,0 +1,352 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package tunnel
+
+import (
+	"github.com/mad-day/cryptoinfra/ciphersuite2"
+	
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/chacha20poly1305"
+	_ "github.com/mad-day/cryptoinfra/ciphersuite2/pk25519"
+)
+
+const testAlgo = "curve25519"
+
+func keyPair(t *testing.T) ([]byte,ciphersuite2.PrivateKey) {
+	t.Helper()
+	pub,priv,err := ciphersuite2.GenerateKeyPair(rand.Reader,testAlgo)
+	if err!=nil { t.Fatal(err) }
+	sk,err := ciphersuite2.LoadPrivateKey(testAlgo,priv)
+	if err!=nil { t.Fatal(err) }
+	return pub,sk
+}
+
+// Returns the configurations of a client and a server, that know each other.
+func configs(t *testing.T) (*Config,*Config) {
+	t.Helper()
+	cpub,cpriv := keyPair(t)
+	spub,spriv := keyPair(t)
+	ccfg := &Config{PK_Algo:testAlgo,PublicKey:cpub,PrivateKey:cpriv,Encoding:"chacha20-poly1305",PeerKey:spub}
+	scfg := &Config{PK_Algo:testAlgo,PublicKey:spub,PrivateKey:spriv,Encoding:"chacha20-poly1305"}
+	scfg.VerifyPeer = func(pk_algo string,pub []byte) error {
+		if !bytes.Equal(pub,cpub) { return fmt.Errorf("Unknown client") }
+		return nil
+	}
+	return ccfg,scfg
+}
+
+// Runs the handshake on both sides. A failing side closes its connection, so the other one doesn't block.
+func handshake(c,s *Conn) (cerr,serr error) {
+	ch := make(chan error,1)
+	go func() {
+		err := s.Handshake()
+		if err!=nil { s.conn.Close() }
+		ch <- err
+	}()
+	cerr = c.Handshake()
+	if cerr!=nil { c.conn.Close() }
+	serr = <-ch
+	return
+}
+
+func connect(t *testing.T,ccfg,scfg *Config) (*Conn,*Conn) {
+	t.Helper()
+	cc,sc := net.Pipe()
+	c,s := Client(cc,ccfg),Server(sc,scfg)
+	cerr,serr := handshake(c,s)
+	if cerr!=nil || serr!=nil { t.Fatalf("handshake: client %v, server %v",cerr,serr) }
+	return c,s
+}
+
+// Writes data on w, while r reads it. net.Pipe is unbuffered.
+func transfer(t *testing.T,w,r net.Conn,data []byte) {
+	t.Helper()
+	ch := make(chan error,1)
+	go func() {
+		_,err := w.Write(data)
+		ch <- err
+	}()
+	got := make([]byte,len(data))
+	_,err := io.ReadFull(r,got)
+	if err!=nil { t.Fatal(err) }
+	if err = <-ch; err!=nil { t.Fatal(err) }
+	if !bytes.Equal(got,data) { t.Fatal("data mismatch") }
+}
+
+func expectError(t *testing.T,err,want error) {
+	t.Helper()
+	if err!=want { t.Fatalf("got %v, want %v",err,want) }
+}
+
+func TestHandshake(t *testing.T) {
+	ccfg,scfg := configs(t)
+	c,s := connect(t,ccfg,scfg)
+	if !bytes.Equal(c.PeerKey(),ccfg.PeerKey) { t.Error("client: wrong PeerKey") }
+	if !bytes.Equal(s.PeerKey(),ccfg.PublicKey) { t.Error("server: wrong PeerKey") }
+	data := make([]byte,3*maxPlain+100)
+	rand.Read(data)
+	transfer(t,c,s,data)
+	transfer(t,s,c,data)
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	errReject := fmt.Errorf("Rejected")
+	wrongKey,_ := keyPair(t)
+	for _,tc := range []struct{
+		name string
+		mod  func(ccfg,scfg *Config)
+		cerr,serr error
+	}{
+		{"wrong server key",func(ccfg,scfg *Config) { ccfg.PeerKey = wrongKey },EHandshake,nil},
+		{"wrong client key",func(ccfg,scfg *Config) { _,ccfg.PrivateKey = keyPair(t) },EHandshake,nil},
+		{"VerifyPeer",func(ccfg,scfg *Config) { scfg.VerifyPeer = func(string,[]byte) error { return errReject } },nil,errReject},
+		{"Encoding",func(ccfg,scfg *Config) { ccfg.Encoding = "xchacha20-poly1305" },nil,HandshakeError("Encoding mismatch")},
+	} {
+		t.Run(tc.name,func(t *testing.T) {
+			ccfg,scfg := configs(t)
+			tc.mod(ccfg,scfg)
+			cc,sc := net.Pipe()
+			c,s := Client(cc,ccfg),Server(sc,scfg)
+			cerr,serr := handshake(c,s)
+			if cerr==nil || serr==nil { t.Fatalf("handshake succeeded: client %v, server %v",cerr,serr) }
+			if tc.cerr!=nil { expectError(t,cerr,tc.cerr) }
+			if tc.serr!=nil { expectError(t,serr,tc.serr) }
+			if c.PeerKey()!=nil || s.PeerKey()!=nil { t.Error("PeerKey after a failed handshake") }
+			_,err := c.Write([]byte("x"))
+			expectError(t,err,cerr)
+		})
+	}
+}
+
+// Rewrites the records written to it.
+type tamperConn struct {
+	net.Conn
+	mu  sync.Mutex
+	mod func(rec []byte) []byte
+}
+func (t *tamperConn) set(mod func(rec []byte) []byte) {
+	t.mu.Lock(); defer t.mu.Unlock()
+	t.mod = mod
+}
+func (t *tamperConn) Write(p []byte) (int,error) {
+	t.mu.Lock()
+	mod := t.mod
+	t.mu.Unlock()
+	if mod==nil { return t.Conn.Write(p) }
+	_,err := t.Conn.Write(mod(append([]byte(nil),p...)))
+	return len(p),err
+}
+
+// Replaces the Finished record of the connection with one, that carries a payload.
+func finishedWithPayload(c **Conn) func(rec []byte) []byte {
+	return func(rec []byte) []byte {
+		if rec[0]!=recFinished { return rec }
+		o := &(*c).out
+		hdr := []byte{recFinished,0,0}
+		payload := []byte("payload")
+		hdr[2] = byte(len(payload)+o.aead.Overhead())
+		return o.aead.Seal(hdr,o.next(),payload,hdr)
+	}
+}
+
+func TestFinishedPayload(t *testing.T) {
+	for _,client := range []bool{false,true} {
+		ccfg,scfg := configs(t)
+		cc,sc := net.Pipe()
+		var c,s *Conn
+		if client {
+			tc := &tamperConn{Conn:cc}
+			tc.set(finishedWithPayload(&c))
+			cc = tc
+		} else {
+			tc := &tamperConn{Conn:sc}
+			tc.set(finishedWithPayload(&s))
+			sc = tc
+		}
+		c,s = Client(cc,ccfg),Server(sc,scfg)
+		cerr,serr := handshake(c,s)
+		if client {
+			expectError(t,serr,EHandshake)
+		} else {
+			expectError(t,cerr,EHandshake)
+		}
+	}
+	
+	// After the handshake, a Finished record is unexpected, with or without payload.
+	ccfg,scfg := configs(t)
+	c,s := connect(t,ccfg,scfg)
+	go func() {
+		c.out.Lock(); defer c.out.Unlock()
+		c.writeRecord(recFinished,nil)
+	}()
+	_,err := s.Read(make([]byte,1))
+	expectError(t,err,EUnexpected)
+}
+
+func TestTamperedRecord(t *testing.T) {
+	ccfg,scfg := configs(t)
+	cc,sc := net.Pipe()
+	tc := &tamperConn{Conn:cc}
+	c,s := Client(tc,ccfg),Server(sc,scfg)
+	cerr,serr := handshake(c,s)
+	if cerr!=nil || serr!=nil { t.Fatalf("handshake: client %v, server %v",cerr,serr) }
+	transfer(t,c,s,[]byte("intact"))
+	for _,mod := range []func(rec []byte) []byte{
+		func(rec []byte) []byte { rec[len(rec)-1] ^= 1; return rec }, // Tag
+		func(rec []byte) []byte { rec[headerSize] ^= 1; return rec }, // Ciphertext
+		func(rec []byte) []byte { rec[0] = recUpdate; return rec }, // Type
+	} {
+		tc.set(mod)
+		go c.Write([]byte("tampered"))
+		_,err := s.Read(make([]byte,16))
+		expectError(t,err,EAuthError)
+		// The error is sticky.
+		_,err = s.Read(make([]byte,16))
+		expectError(t,err,EAuthError)
+		s.in.err = nil
+		s.in.seq++
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	for _,cut := range []int{0,1,headerSize,headerSize+5} {
+		ccfg,scfg := configs(t)
+		cc,sc := net.Pipe()
+		tc := &tamperConn{Conn:cc}
+		c,s := Client(tc,ccfg),Server(sc,scfg)
+		cerr,serr := handshake(c,s)
+		if cerr!=nil || serr!=nil { t.Fatalf("handshake: client %v, server %v",cerr,serr) }
+		tc.set(func(rec []byte) []byte { return rec[:cut] })
+		go func() {
+			c.Write([]byte("lost"))
+			cc.Close()
+		}()
+		_,err := s.Read(make([]byte,16))
+		expectError(t,err,ETruncated)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	ccfg,scfg := configs(t)
+	ccfg.RekeyAfter = 3
+	c,s := connect(t,ccfg,scfg)
+	first := c.out.secret
+	data := make([]byte,10*maxPlain)
+	rand.Read(data)
+	transfer(t,c,s,data)
+	if bytes.Equal(c.out.secret,first) { t.Fatal("the sending key was not updated") }
+	if c.out.seq>ccfg.RekeyAfter { t.Errorf("%d records with one key, RekeyAfter is %d",c.out.seq,ccfg.RekeyAfter) }
+	if !bytes.Equal(c.out.secret,s.in.secret) { t.Error("the peers disagree on the key") }
+	
+	// Explicit update by the server.
+	first = s.out.secret
+	ch := make(chan error,1)
+	go func() {
+		err := s.Rekey()
+		if err==nil { _,err = s.Write([]byte("after rekey")) }
+		ch <- err
+	}()
+	buf := make([]byte,16)
+	n,err := c.Read(buf)
+	if err!=nil || string(buf[:n])!="after rekey" { t.Fatalf("got %q, %v",buf[:n],err) }
+	if err = <-ch; err!=nil { t.Fatal(err) }
+	if bytes.Equal(s.out.secret,first) || !bytes.Equal(s.out.secret,c.in.secret) { t.Error("Rekey") }
+}
+
+func TestCloseWrite(t *testing.T) {
+	ccfg,scfg := configs(t)
+	c,s := connect(t,ccfg,scfg)
+	go c.CloseWrite()
+	n,err := s.Read(make([]byte,16))
+	if n!=0 || err!=io.EOF { t.Fatalf("got %d, %v, want io.EOF",n,err) }
+	_,err = s.Read(make([]byte,16))
+	expectError(t,err,io.EOF)
+	_,err = c.Write([]byte("x"))
+	expectError(t,err,EWriteClosed)
+	
+	// The other direction is still open.
+	transfer(t,s,c,[]byte("reply"))
+}
+
+// Holds every write back, until release is closed.
+type slowConn struct {
+	net.Conn
+	release chan bool
+}
+func (s *slowConn) Write(p []byte) (int,error) {
+	n,err := s.Conn.Write(p[:2])
+	if err!=nil { return n,err }
+	<-s.release
+	m,err := s.Conn.Write(p[2:])
+	return n+m,err
+}
+
+func TestDeadline(t *testing.T) {
+	ccfg,scfg := configs(t)
+	cc,sc := net.Pipe()
+	c,s := Client(cc,ccfg),Server(sc,scfg)
+	cerr,serr := handshake(c,s)
+	if cerr!=nil || serr!=nil { t.Fatalf("handshake: client %v, server %v",cerr,serr) }
+	
+	// A read timeout in the middle of a record.
+	slow := &slowConn{Conn:cc,release:make(chan bool)}
+	c.conn = slow
+	done := make(chan error,1)
+	go func() {
+		_,err := c.Write([]byte("late"))
+		done <- err
+	}()
+	s.SetReadDeadline(time.Now().Add(20*time.Millisecond))
+	buf := make([]byte,16)
+	_,err := s.Read(buf)
+	var ne net.Error
+	if !errors.As(err,&ne) || !ne.Timeout() { t.Fatalf("got %v, want a timeout",err) }
+	
+	// The read can be retried.
+	s.SetReadDeadline(time.Time{})
+	close(slow.release)
+	n,err := s.Read(buf)
+	if err!=nil { t.Fatal(err) }
+	if string(buf[:n])!="late" { t.Fatalf("got %q",buf[:n]) }
+	if err = <-done; err!=nil { t.Fatal(err) }
+	c.conn = cc
+	transfer(t,c,s,[]byte("after timeout"))
+	
+	// A write timeout makes the sending side unusable.
+	s.SetWriteDeadline(time.Now().Add(20*time.Millisecond))
+	_,err = s.Write([]byte("unread"))
+	if !errors.As(err,&ne) || !ne.Timeout() { t.Fatalf("got %v, want a timeout",err) }
+	s.SetWriteDeadline(time.Time{})
+	_,err2 := s.Write([]byte("again"))
+	expectError(t,err2,err)
+}
@@ -0,0 +1,250 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package format2
+
+import "bytes"
+import "bufio"
+import "crypto/rand"
+import "io"
+import "fmt"
+
+var ENotAppendable = fmt.Errorf("Stream can not be appended to")
+
+/*
+A file, that can be appended to. *os.File implements it.
+*/
+type AppendFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+type offsetWriter struct {
+	f   io.WriterAt
+	off int64
+}
+func (o *offsetWriter) Write(p []byte) (int,error) {
+	n,err := o.f.WriteAt(p,o.off)
+	o.off += int64(n)
+	return n,err
+}
+
+/*
+Reopens the stream in f (of the given size) and returns a Writer, that continues it.
+decr recovers the content key, for instance the recipient's private key or a retained
+session key (see ciphersuite2.SessionKey).
+
+The final chunk is authenticated and decrypted. Its plaintext is written again as a regular
+chunk, followed by the new data and a new final chunk. The chunk counters continue, so the
+usual integrity and ordering guarantees hold.
+
+The new records are written behind the end of the old stream, which stays intact. If Write
+or Close fail, f is truncated to size again. Only once the new stream is complete, Close
+moves the new records over the old final chunk (and anything following it, like the Index),
+and truncates f behind them. A crash before that leaves the old stream followed by garbage,
+the first size bytes of f are still valid. A crash while moving leaves a damaged stream,
+that RecoveryReader can salvage up to the old final chunk.
+
+The rewritten chunk starts a new key epoch (see CipherObject.Next), which mixes in a random
+salt, stored in the chunk (Data.Salt). So its nonce or key stream is not the one of the old
+final chunk, which encrypted different data, and appending twice to the same state of a
+file (for instance, to a restored backup) uses different keys as well. As the new final
+chunk comes after the rewritten one, the Index is sealed with a new chunk count, and thus a
+new nonce, as well. The epoch of the old final chunk is skipped, if that was its only chunk.
+
+Only AEAD ciphers and Stream ciphers with StreamAt are supported, that can derive the next
+key epoch. Signed streams can not be appended to.
+
+The Index is kept, if the stream has one. If the stream is padded, opt.Padding
+is used to pad it again (defaults to the smallest possible padding), the empty chunks of the
+old padding stay in place. The other Header fields
+(compression, MaxChunk) are taken from the stream, as they are authenticated with it.
+opt.Random is the source of the salt.
+
+Appends to the same file must be serialized.
+*/
+func Append(f AppendFile,size int64,decr Decrypter,opt *WriterOptions) (io.WriteCloser,error) {
+	if opt==nil { opt = new(WriterOptions) }
+	rec := newRecReader(io.NewSectionReader(f,0,size))
+	r := &Reader{rec:rec,opt:new(ReaderOptions).defaults()}
+	var err error
+	r.dec,err = r.head.read(rec,decr,r.opt)
+	if err!=nil { return nil,headerError(err,rec) }
+	if r.header.Signature!="" || r.cipher.Next==nil { return nil,ENotAppendable }
+	switch r.cipher.mode() {
+	case mStream: if r.cipher.StreamAt==nil { return nil,ENotAppendable }
+	case mAEAD:
+	default: return nil,ENotAppendable
+	}
+	
+	// Locate the final chunk, and the first chunk of its key epoch.
+	var index *indexBody
+	var off,cpos,ppos,ecpos int64
+	var plain []byte
+	if hasIndex(f,size) {
+		g,err := NewSeekReader(f,size,decr)
+		if err!=nil { return nil,err }
+		last := len(g.index.Offsets)-1
+		err = g.load(last)
+		if err!=nil { return nil,err }
+		off,cpos,ppos,plain = g.index.Offsets[last],g.index.Cipher[last],g.index.Plain[last],g.data
+		r.counter = uint64(last)
+		e,_ := g.epochOf(last)
+		r.salts = g.salts
+		err = r.seekEpoch(e)
+		if err!=nil { return nil,err }
+		index = &g.index
+		index.Offsets,index.Plain,index.Cipher = index.Offsets[:last],index.Plain[:last],index.Cipher[:last]
+		for i := range index.Offsets { index.Offsets[i] -= g.origin }
+	} else {
+		// Only the framing of the records in front of it is decoded.
+		for {
+			off = rec.pos
+			err = r.decodeData()
+			if err==io.EOF || err==io.ErrUnexpectedEOF { err = ETruncated }
+			if err!=nil { return nil,err }
+			e := r.epoch
+			err = r.follow(r.cached.Epoch,r.cached.Salt)
+			if err!=nil { return nil,err }
+			if r.epoch!=e { ecpos = cpos }
+			if r.cached.Last { break }
+			cpos += int64(len(r.cached.Data))
+			r.counter++
+		}
+		r.coder = rAEAD
+		if r.cipher.mode()==mStream {
+			r.coder = rStream
+			err = r.keyStream(cpos-ecpos)
+			if err!=nil { return nil,err }
+		}
+		err = r.coder(r)
+		if err!=nil { return nil,err }
+		plain = r.buffer.Bytes()
+	}
+	
+	random := opt.Random
+	if random==nil { random = rand.Reader }
+	salt := make([]byte,saltSize)
+	_,err = io.ReadFull(random,salt)
+	if err!=nil { return nil,err }
+	
+	// The records are positioned at off, but written behind the old stream (see appender).
+	bw := bufio.NewWriter(&offsetWriter{f:f,off:size})
+	w := &Writer{
+		head:r.head,
+		writer:bw,
+		count:&countWriter{Writer:bw,n:off},
+		counter:r.counter,
+		resume:r.counter+1,
+		salt:salt,
+		index:index,
+	}
+	w.enc = w.codec.NewEncoder(w.count)
+	
+	// The new epoch, the key stream of Stream ciphers starts over.
+	w.setSalt(w.epoch+1,salt)
+	err = w.nextEpoch()
+	if err!=nil { return nil,err }
+	err = w.setupRekey(opt)
+	if err!=nil { return nil,err }
+	w.coder = wAEAD
+	if w.cipher.mode()==mStream { w.coder = wStream }
+	if index!=nil {
+		// Older Indexes omit the Salts, if there are none.
+		for len(index.Salts)<len(index.Epochs) { index.Salts = append(index.Salts,nil) }
+		index.Epochs = append(index.Epochs,int64(w.counter))
+		index.Salts = append(index.Salts,salt)
+		index.salt = salt
+		index.cpos = cpos
+		w.plain = ppos
+	}
+	if w.header.Padding {
+		w.padding = opt.Padding
+		if w.padding==nil { w.padding = PadMultiple(1) }
+	}
+	w.chunk = opt.ChunkSize
+	if w.chunk<=0 { w.chunk = DefaultChunkSize }
+	if int64(w.chunk)>w.header.MaxChunk { w.chunk = int(w.header.MaxChunk) }
+	if w.chunk<len(plain) { w.chunk = len(plain) }
+	w.buffer.Write(plain)
+	return &appender{Writer:w,f:f,off:off,size:size},nil
+}
+
+const saltSize = 16
+
+/*
+The Writer of Append. The new records are written behind the old stream, which ends at size.
+Close moves them to off, where the old final chunk begins.
+*/
+type appender struct {
+	*Writer
+	f    AppendFile
+	off  int64
+	size int64
+}
+func (a *appender) Close() error {
+	if a.f==nil { return EClosed }
+	f := a.f
+	a.f = nil
+	err := a.Writer.Close()
+	if err!=nil {
+		f.Truncate(a.size)
+		return err
+	}
+	n := a.count.n-a.off
+	buf := make([]byte,64<<10)
+	// The target lies in front of the source, so copying forwards never overwrites
+	// what is still to be copied.
+	for i := int64(0); i<n; {
+		m := int64(len(buf))
+		if n-i<m { m = n-i }
+		_,err = f.ReadAt(buf[:m],a.size+i)
+		if err==nil { _,err = f.WriteAt(buf[:m],a.off+i) }
+		if err!=nil { return err }
+		i += m
+	}
+	return f.Truncate(a.off+n)
+}
+
+// Reports, whether the stream ends with the footer of an Index.
+func hasIndex(f io.ReaderAt,size int64) bool {
+	if size<footerSize { return false }
+	b := make([]byte,footerSize)
+	_,err := f.ReadAt(b,size-footerSize)
+	return err==nil && bytes.Equal(b[8:],footerMagic)
+}
+
+/*
+Stream ciphers only: Positions the key stream at the ciphertext offset off of the chunks
+in the current key epoch.
+*/
+func (h *head) keyStream(off int64) error {
+	// The key stream of epoch 0 starts with the encrypted MAC key and the Metadata.
+	if h.epoch==0 { off += int64(len(h.header.Key)+len(h.metaRaw)) }
+	s,err := h.cipher.StreamAt(off)
+	if err!=nil { return err }
+	c := *h.cipher
+	c.Stream = s
+	h.cipher = &c
+	return nil
+}
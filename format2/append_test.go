@@ -0,0 +1,125 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package format2
+
+import "bytes"
+import "fmt"
+import "io/ioutil"
+import "testing"
+
+func appendData(t *testing.T,f *memFile,decr Decrypter,opt *WriterOptions,more []byte) {
+	t.Helper()
+	w,err := Append(f,int64(len(f.b)),decr,opt)
+	if err!=nil { t.Fatal(err) }
+	_,err = w.Write(more)
+	if err!=nil { t.Fatal(err) }
+	err = w.Close()
+	if err!=nil { t.Fatal(err) }
+}
+
+func checkAppended(t *testing.T,f *memFile,decr Decrypter,opt *WriterOptions,data []byte) {
+	t.Helper()
+	if pt := decryptAll(t,decr,f.b); !bytes.Equal(pt,data) { t.Fatal("plaintext mismatch") }
+	if !opt.Index { return }
+	g,err := NewSeekReader(bytes.NewReader(f.b),int64(len(f.b)),decr)
+	if err!=nil { t.Fatal(err) }
+	pt,err := ioutil.ReadAll(g)
+	if err!=nil { t.Fatal(err) }
+	if !bytes.Equal(pt,data) { t.Fatal("SeekReader: plaintext mismatch") }
+}
+
+/*
+No nonce and no key stream offset may be used twice across several appends, even if
+two of them start from the same state of the file.
+*/
+func TestAppendKeyReuse(t *testing.T) {
+	for _,mode := range []int{mAEAD,mStream} {
+		for _,opt := range []WriterOptions{
+			{ChunkSize:512},
+			{ChunkSize:512,Index:true},
+			{ChunkSize:512,Index:true,Padding:PadMultiple(256)},
+			{ChunkSize:512,Index:true,Codec:"binary"},
+			{ChunkSize:512,Index:true,RekeyChunks:2},
+		} {
+			o := opt
+			t.Run(fmt.Sprintf("mode %d, %+v",mode,opt),func(t *testing.T) {
+				log := newKeyLog()
+				ts := &testSuite{Mode:mode,Next:true,Log:log}
+				data := testData(1000)
+				f := &memFile{b:encryptAll(t,ts,&o,data)}
+				for _,n := range []int{1,0,700,3} {
+					more := testData(n+len(data))[len(data):]
+					appendData(t,f,ts,&o,more)
+					data = append(data,more...)
+					checkAppended(t,f,ts,&o,data)
+				}
+				
+				// The same state, appended to twice (a restored backup).
+				g := &memFile{b:append([]byte(nil),f.b...)}
+				appendData(t,f,ts,&o,[]byte("first"))
+				appendData(t,g,ts,&o,[]byte("other"))
+				checkAppended(t,f,ts,&o,append(append([]byte(nil),data...),"first"...))
+				checkAppended(t,g,ts,&o,append(append([]byte(nil),data...),"other"...))
+				if len(log.reuse)!=0 { t.Errorf("key reuse: %v",log.reuse) }
+			})
+		}
+	}
+}
+
+// A file, whose writes fail after limit bytes.
+type failFile struct {
+	memFile
+	limit int
+}
+func (f *failFile) WriteAt(p []byte,off int64) (int,error) {
+	if len(p)>f.limit { return 0,fmt.Errorf("disk full") }
+	f.limit -= len(p)
+	return f.memFile.WriteAt(p,off)
+}
+
+// The old stream stays intact until Close, and is restored, if writing fails.
+func TestAppendFailure(t *testing.T) {
+	ts := &testSuite{Mode:mAEAD,Next:true}
+	opt := &WriterOptions{ChunkSize:512,Index:true}
+	data := testData(1000)
+	old := encryptAll(t,ts,opt,data)
+	for _,limit := range []int{0,100,3000} {
+		f := &failFile{memFile:memFile{b:append([]byte(nil),old...)},limit:limit}
+		w,err := Append(f,int64(len(old)),ts,opt)
+		if err!=nil { t.Fatal(err) }
+		w.Write(testData(5000))
+		if pt := decryptAll(t,ts,f.b[:len(old)]); !bytes.Equal(pt,data) { t.Fatalf("limit %d: old stream damaged before Close",limit) }
+		err = w.Close()
+		if err==nil { t.Fatalf("limit %d: no error",limit) }
+		if !bytes.Equal(f.b,old) { t.Fatalf("limit %d: old stream not restored",limit) }
+		if w.Close()!=EClosed { t.Fatalf("limit %d: second Close",limit) }
+	}
+}
+
+// Without CipherObject.Next, there is no new epoch for the appended data.
+func TestAppendWithoutNext(t *testing.T) {
+	ts := &testSuite{Mode:mAEAD}
+	f := &memFile{b:encryptAll(t,ts,nil,testData(100))}
+	_,err := Append(f,int64(len(f.b)),ts,nil)
+	if err!=ENotAppendable { t.Fatalf("got %v, want ENotAppendable",err) }
+}
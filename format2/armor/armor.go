@@ -0,0 +1,328 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+ASCII-Armor for format2 streams.
+
+	-----BEGIN FORMAT2 MESSAGE-----
+	Encoding: aes-256/gcm
+	PK_Algo: curve25519
+
+	wUYyAZPEIH9t7Hz6eHCZs4pSSWxj+ckhSzAOzQOMOKRUqq0ChNE/8K5Lzqp17Cku
+	...
+	=nbAf
+	-----END FORMAT2 MESSAGE-----
+
+The header lines are informational only, they are not authenticated.
+The checksum is a CRC-24 (as in OpenPGP) over the binary stream. It is optional for the Reader.
+*/
+package armor
+
+import "github.com/mad-day/cryptoinfra/format2"
+import "encoding/base64"
+import "fmt"
+import "bytes"
+import "io"
+import "bufio"
+import "sort"
+import "strings"
+
+var (
+	ENoArmor = fmt.Errorf("No Armor found")
+	EMalformed = fmt.Errorf("Malformed Armor")
+	EChecksum = fmt.Errorf("Armor Checksum Mismatch")
+)
+
+const (
+	beginLine = "-----BEGIN FORMAT2 MESSAGE-----"
+	endLine   = "-----END FORMAT2 MESSAGE-----"
+	lineSize  = 64
+)
+
+const (
+	crc24Init = 0xB704CE
+	crc24Poly = 0x1864CFB
+)
+func crc24(crc uint32,p []byte) uint32 {
+	for _,b := range p {
+		crc ^= uint32(b)<<16
+		for i := 0; i<8; i++ {
+			crc <<= 1
+			if (crc&0x1000000)!=0 { crc ^= crc24Poly }
+		}
+	}
+	return crc&0xFFFFFF
+}
+func crcString(crc uint32) string {
+	return "="+base64.StdEncoding.EncodeToString([]byte{byte(crc>>16),byte(crc>>8),byte(crc)})
+}
+
+// Breaks the base64 output into lines.
+type lineWriter struct {
+	w   io.Writer
+	col int
+}
+func (l *lineWriter) Write(p []byte) (n int,err error) {
+	for len(p)>0 {
+		m := lineSize-l.col
+		if m>len(p) { m = len(p) }
+		_,err = l.w.Write(p[:m])
+		if err!=nil { return }
+		n += m
+		l.col += m
+		p = p[m:]
+		if l.col==lineSize {
+			_,err = io.WriteString(l.w,"\n")
+			if err!=nil { return }
+			l.col = 0
+		}
+	}
+	return
+}
+
+type encoder struct {
+	w       io.Writer
+	header  map[string]string
+	lines   *lineWriter
+	b64     io.WriteCloser
+	crc     uint32
+	started bool
+}
+func (e *encoder) start() error {
+	if e.started { return nil }
+	e.started = true
+	var b bytes.Buffer
+	b.WriteString(beginLine+"\n")
+	keys := make([]string,0,len(e.header))
+	for k := range e.header { keys = append(keys,k) }
+	sort.Strings(keys)
+	for _,k := range keys { fmt.Fprintf(&b,"%s: %s\n",k,e.header[k]) }
+	b.WriteString("\n")
+	_,err := e.w.Write(b.Bytes())
+	return err
+}
+func (e *encoder) Write(p []byte) (int,error) {
+	err := e.start()
+	if err!=nil { return 0,err }
+	e.crc = crc24(e.crc,p)
+	return e.b64.Write(p)
+}
+func (e *encoder) Close() error {
+	err := e.start()
+	if err!=nil { return err }
+	err = e.b64.Close()
+	if err!=nil { return err }
+	tail := crcString(e.crc)+"\n"+endLine+"\n"
+	if e.lines.col>0 { tail = "\n"+tail }
+	_,err = io.WriteString(e.w,tail)
+	return err
+}
+
+/*
+Returns a WriteCloser, that armors everything written to it. Header may be nil.
+Close must be called to write the checksum and the END line. Close does not close w.
+*/
+func Encode(w io.Writer,header map[string]string) io.WriteCloser {
+	e := &encoder{w:w,header:header,lines:&lineWriter{w:w},crc:crc24Init}
+	e.b64 = base64.NewEncoder(base64.StdEncoding,e.lines)
+	return e
+}
+
+// Supplies the header lines from the Preamble.
+type headerEncrypter struct {
+	format2.Encrypter
+	e *encoder
+}
+func (h *headerEncrypter) StartEncryption() (*format2.Preamble, *format2.CipherObject, error) {
+	p,c,err := h.Encrypter.StartEncryption()
+	if err!=nil { return nil,nil,err }
+	h.e.header = Header(p)
+	return p,c,nil
+}
+
+/*
+Returns the informational header lines for a Preamble.
+*/
+func Header(p *format2.Preamble) map[string]string {
+	m := make(map[string]string)
+	if p.PK_Algo!="" { m["PK_Algo"] = p.PK_Algo }
+	if p.Encoding!="" { m["Encoding"] = p.Encoding }
+	if len(p.Recipients)>0 {
+		algos := make([]string,len(p.Recipients))
+		for i,r := range p.Recipients { algos[i] = r.PK_Algo }
+		m["Recipients"] = strings.Join(algos,", ")
+	}
+	return m
+}
+
+/*
+An armored format2.Writer. Close closes both.
+*/
+type Writer struct {
+	*format2.Writer
+	armor io.WriteCloser
+}
+func (w *Writer) Close() error {
+	err := w.Writer.Close()
+	if err!=nil { return err }
+	return w.armor.Close()
+}
+
+/*
+Like format2.NewWriter, but the output is armored.
+
+NOTE: Returns a *Writer object.
+*/
+func NewWriter(w io.Writer, enc format2.Encrypter) (io.WriteCloser,error) {
+	return NewWriter2(w,enc,nil)
+}
+
+/*
+Like format2.NewWriter2, but the output is armored.
+
+NOTE: Returns a *Writer object.
+*/
+func NewWriter2(w io.Writer, enc format2.Encrypter, opt *format2.WriterOptions) (io.WriteCloser,error) {
+	e := Encode(w,nil).(*encoder)
+	fw,err := format2.NewWriter2(e,&headerEncrypter{enc,e},opt)
+	if err!=nil { return nil,err }
+	return &Writer{fw.(*format2.Writer),e},nil
+}
+
+type decoder struct {
+	r    *bufio.Reader
+	bol  bool   // At the beginning of a line.
+	rest []byte // Base64 characters, that have not been decoded yet.
+	buf  []byte // Decoded bytes.
+	out  []byte
+	crc  uint32
+	err  error
+}
+func (d *decoder) Read(p []byte) (int,error) {
+	for len(d.buf)==0 {
+		if d.err!=nil { return 0,d.err }
+		d.fill()
+	}
+	n := copy(p,d.buf)
+	d.buf = d.buf[n:]
+	return n,nil
+}
+func (d *decoder) fill() {
+	line,err := d.r.ReadSlice('\n')
+	bol := d.bol
+	d.bol = err==nil
+	if err==bufio.ErrBufferFull { err = nil }
+	text := bytes.TrimSpace(line)
+	switch {
+	case bol && bytes.HasPrefix(text,[]byte("-----END")):
+		d.finish(text)
+		return
+	case bol && len(text)>0 && text[0]=='=':
+		if crcString(d.crc)!=string(text) { d.err = EChecksum ; return }
+		end,err2 := readLine(d.r)
+		if err2!=nil { d.err = err2 ; return }
+		d.finish(end)
+		return
+	}
+	d.rest = append(d.rest,text...)
+	n := len(d.rest)-(len(d.rest)%4)
+	if l := base64.StdEncoding.DecodedLen(n); cap(d.out)<l { d.out = make([]byte,l) }
+	m,err2 := base64.StdEncoding.Decode(d.out[:cap(d.out)],d.rest[:n])
+	if err2!=nil { d.err = EMalformed ; return }
+	d.buf = d.out[:m]
+	d.crc = crc24(d.crc,d.buf)
+	d.rest = append(d.rest[:0],d.rest[n:]...)
+	if err==io.EOF { err = io.ErrUnexpectedEOF }
+	d.err = err
+}
+func (d *decoder) finish(end []byte) {
+	if string(end)!=endLine || len(d.rest)!=0 { d.err = EMalformed ; return }
+	d.err = io.EOF
+}
+
+// Reads a line of the armor header.
+func readLine(r *bufio.Reader) ([]byte,error) {
+	line,err := r.ReadSlice('\n')
+	if err==bufio.ErrBufferFull { return nil,EMalformed }
+	if err==io.EOF && len(line)>0 { err = nil }
+	if err==io.EOF { err = io.ErrUnexpectedEOF }
+	return bytes.TrimSpace(line),err
+}
+
+/*
+Decodes an armored stream. Returns the header lines and the binary stream.
+Reading from the body returns EChecksum, if the checksum does not match.
+*/
+func Decode(r io.Reader) (header map[string]string, body io.Reader, err error) {
+	br,ok := r.(*bufio.Reader)
+	if !ok { br = bufio.NewReader(r) }
+	var line []byte
+	for len(line)==0 {
+		line,err = readLine(br)
+		if err==io.ErrUnexpectedEOF { err = ENoArmor }
+		if err!=nil { return }
+	}
+	if string(line)!=beginLine { return nil,nil,ENoArmor }
+	header = make(map[string]string)
+	for {
+		line,err = readLine(br)
+		if err!=nil { return nil,nil,err }
+		if len(line)==0 { break }
+		i := bytes.IndexByte(line,':')
+		if i<0 { return nil,nil,EMalformed }
+		header[string(line[:i])] = string(bytes.TrimSpace(line[i+1:]))
+	}
+	return header,&decoder{r:br,bol:true,crc:crc24Init},nil
+}
+
+/*
+Reports, whether r starts with an armor (leading white space is skipped).
+*/
+func IsArmored(r *bufio.Reader) bool {
+	for n := 1; ; n++ {
+		b,_ := r.Peek(n)
+		if len(b)<n { return false }
+		t := bytes.TrimLeft(b," \t\r\n")
+		if len(t)>=len(beginLine) { return bytes.HasPrefix(t,[]byte(beginLine)) }
+		if !bytes.HasPrefix([]byte(beginLine),t) { return false }
+		if n==r.Size() { return false }
+	}
+}
+
+/*
+Like format2.NewReader, but accepts both armored and binary input.
+*/
+func NewReader(r io.Reader,decr format2.Decrypter) (io.Reader,error) {
+	return NewReader2(r,decr,nil)
+}
+
+/*
+Like format2.NewReader2, but accepts both armored and binary input.
+*/
+func NewReader2(r io.Reader,decr format2.Decrypter,opt *format2.ReaderOptions) (io.Reader,error) {
+	br := bufio.NewReader(r)
+	if !IsArmored(br) { return format2.NewReader2(br,decr,opt) }
+	_,body,err := Decode(br)
+	if err!=nil { return nil,err }
+	return format2.NewReader2(body,decr,opt)
+}
@@ -0,0 +1,162 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package armor
+
+import "github.com/mad-day/cryptoinfra/format2"
+import "bufio"
+import "crypto/aes"
+import "crypto/cipher"
+import "bytes"
+import "io"
+import "io/ioutil"
+import "strings"
+import "testing"
+
+// AES-256-GCM with a fixed key.
+type testSuite struct{}
+func (testSuite) StartEncryption() (*format2.Preamble,*format2.CipherObject,error) {
+	p := &format2.Preamble{PK_Algo:"test",Encoding:"aes-256/gcm"}
+	c,err := testSuite{}.StartDecryption(p)
+	return p,c,err
+}
+func (testSuite) StartDecryption(p *format2.Preamble) (*format2.CipherObject,error) {
+	b,err := aes.NewCipher(make([]byte,32))
+	if err!=nil { return nil,err }
+	g,err := cipher.NewGCM(b)
+	if err!=nil { return nil,err }
+	return &format2.CipherObject{AEAD:g},nil
+}
+
+func testData(n int) []byte {
+	b := make([]byte,n)
+	for i := range b { b[i] = byte(i*7+i/251) }
+	return b
+}
+
+func armor(t *testing.T,header map[string]string,data []byte) string {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	w := Encode(buf,header)
+	_,err := w.Write(data)
+	if err==nil { err = w.Close() }
+	if err!=nil { t.Fatal(err) }
+	return buf.String()
+}
+
+func dearmor(s string) (map[string]string,[]byte,error) {
+	h,body,err := Decode(strings.NewReader(s))
+	if err!=nil { return nil,nil,err }
+	data,err := ioutil.ReadAll(body)
+	return h,data,err
+}
+
+func TestEncode(t *testing.T) {
+	header := map[string]string{"Encoding":"aes-256/gcm","Comment":"a: b"}
+	for _,n := range []int{0,1,2,3,47,48,49,1000} {
+		data := testData(n)
+		s := armor(t,header,data)
+		lines := strings.Split(strings.TrimSuffix(s,"\n"),"\n")
+		if lines[0]!=beginLine || lines[len(lines)-1]!=endLine { t.Fatalf("%d bytes: %q",n,s) }
+		if lines[1]!="Comment: a: b" || lines[2]!="Encoding: aes-256/gcm" || lines[3]!="" { t.Errorf("%d bytes: header lines %q",n,lines[1:4]) }
+		if !strings.HasPrefix(lines[len(lines)-2],"=") { t.Errorf("%d bytes: no checksum",n) }
+		body := lines[4:len(lines)-2]
+		for i,l := range body {
+			if len(l)>lineSize || (i<len(body)-1 && len(l)!=lineSize) { t.Errorf("%d bytes: line %d has %d characters",n,i,len(l)) }
+		}
+		h,got,err := dearmor(s)
+		if err!=nil || !bytes.Equal(got,data) { t.Errorf("%d bytes: %v",n,err) }
+		if len(h)!=2 || h["Comment"]!="a: b" || h["Encoding"]!="aes-256/gcm" { t.Errorf("%d bytes: header %v",n,h) }
+		
+		// CRLF line endings.
+		_,got,err = dearmor(strings.Replace(s,"\n","\r\n",-1))
+		if err!=nil || !bytes.Equal(got,data) { t.Errorf("%d bytes, CRLF: %v",n,err) }
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	s := armor(t,map[string]string{"Encoding":"aes-256/gcm"},testData(100))
+	lines := strings.Split(s,"\n")
+	body,sum := 3,len(lines)-3
+	set := func(i int,l string) string {
+		c := append([]string(nil),lines...)
+		c[i] = l
+		return strings.Join(c,"\n")
+	}
+	remove := func(i int) string {
+		return strings.Join(append(append([]string(nil),lines[:i]...),lines[i+1:]...),"\n")
+	}
+	
+	// The checksum is optional.
+	if _,_,err := dearmor(remove(sum)); err!=nil { t.Errorf("no checksum: %v",err) }
+	
+	changed := []byte(lines[body])
+	if changed[10]=='A' { changed[10] = 'B' } else { changed[10] = 'A' }
+	for _,tc := range []struct{
+		name string
+		s    string
+		want error
+	}{
+		{"checksum",set(sum,"=AAAA"),EChecksum},
+		{"body",set(body,string(changed)),EChecksum},
+		{"header line",set(1,"Encoding aes-256/gcm"),EMalformed},
+		{"base64",set(body,"*"+lines[body][1:]),EMalformed},
+		{"END line",set(sum+1,"-----END FORMAT2 MESSAGE"),EMalformed},
+		{"BEGIN line",set(0,"-----BEGIN PGP MESSAGE-----"),ENoArmor},
+		{"empty","",ENoArmor},
+		{"truncated",strings.Join(lines[:body+1],"\n"),io.ErrUnexpectedEOF},
+	} {
+		_,_,err := dearmor(tc.s)
+		if err!=tc.want { t.Errorf("%s: got %v, want %v",tc.name,err,tc.want) }
+	}
+}
+
+func TestReaderWriter(t *testing.T) {
+	data := testData(5000)
+	buf := new(bytes.Buffer)
+	w,err := NewWriter2(buf,testSuite{},&format2.WriterOptions{ChunkSize:1024})
+	if err!=nil { t.Fatal(err) }
+	_,err = w.Write(data)
+	if err==nil { err = w.Close() }
+	if err!=nil { t.Fatal(err) }
+	s := buf.String()
+	h,_,err := dearmor(s)
+	if err!=nil || h["Encoding"]!="aes-256/gcm" || h["PK_Algo"]!="test" { t.Fatalf("header %v, %v",h,err) }
+	
+	bin := new(bytes.Buffer)
+	fw,err := format2.NewWriter(bin,testSuite{})
+	if err!=nil { t.Fatal(err) }
+	_,err = fw.Write(data)
+	if err==nil { err = fw.Close() }
+	if err!=nil { t.Fatal(err) }
+	
+	// NewReader accepts both, armored input after white space.
+	for name,in := range map[string]string{"armored":s,"white space":"\n \r\n\t"+s,"binary":bin.String()} {
+		if name!="binary" && !IsArmored(bufio.NewReader(strings.NewReader(in))) { t.Errorf("%s: not armored",name) }
+		r,err := NewReader(strings.NewReader(in),testSuite{})
+		if err!=nil { t.Fatalf("%s: %v",name,err) }
+		got,err := ioutil.ReadAll(r)
+		if err!=nil || !bytes.Equal(got,data) { t.Errorf("%s: %v",name,err) }
+	}
+	if IsArmored(bufio.NewReader(bin)) { t.Error("binary stream taken for armor") }
+}
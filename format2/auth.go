@@ -0,0 +1,241 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package format2
+
+import "crypto/hmac"
+import "crypto/sha256"
+import "hash"
+import "math"
+import "fmt"
+
+var (
+	EHeaderError = fmt.Errorf("Malformed Header")
+	EHeaderAuth = fmt.Errorf("Header Authentication Failed: wrong key or tampered Preamble/Header")
+	EAuthError = fmt.Errorf("Chunk Authentication Failed")
+)
+
+var headerAD = []byte("format2-header")
+
+const (
+	macKeySize = 32
+	macSize = 16
+)
+
+/*
+The binding of a stream is the SHA-256 hash over the magic, the serialized Preamble and Header.
+
+It is appended to the associated data of every AEAD chunk, and fed into the MAC of
+Block and Stream ciphers. Any change to the Preamble or Header (for instance
+a different Encoding) lets the decryption fail.
+*/
+func makeBinding(raw []byte) []byte {
+	h := sha256.Sum256(raw)
+	return h[:]
+}
+
+/*
+Sets the binding from the serialized parts of the stream head: the prefix (magic and codec),
+the Preamble and the Header. For Wrapped streams, the Preamble is bound without the key
+wrapping (Opaque, PK_Algo and Recipients), and h.origin is set to the offset of the Header.
+*/
+func (h *head) bind(prefix,pre,hdr []byte) error {
+	raw := append(prefix[:len(prefix):len(prefix)],pre...)
+	if h.pre.Wrapped {
+		h.origin = int64(len(raw))
+		bound,err := marshal(h.codec,func(e Encoder) error {
+			return encodePreamble(e,&Preamble{Encoding:h.pre.Encoding,Wrapped:true})
+		})
+		if err!=nil { return err }
+		raw = append(prefix[:len(prefix):len(prefix)],bound...)
+	}
+	h.binding = makeBinding(append(raw,hdr...))
+	return nil
+}
+
+/*
+Encrypt-then-MAC for Block and Stream ciphers, which have no authentication on their own.
+
+HMAC-SHA256 truncated to 16 bytes. The MAC key is chosen randomly by the Writer
+and transmitted in Header.Key, encrypted with the cipher.
+*/
+type macer struct {
+	h       hash.Hash
+	key     []byte
+	binding []byte
+	sum     []byte
+}
+func newMacer(key,binding []byte) *macer {
+	return &macer{h:hmac.New(sha256.New,key),key:key,binding:binding}
+}
+// Derives a 32 byte subkey of the MAC key: HMAC-SHA256(key,label).
+func (m *macer) derive(label []byte) []byte {
+	h := hmac.New(sha256.New,m.key)
+	h.Write(label)
+	return h.Sum(nil)
+}
+func (m *macer) tag(dst []byte,parts ...[]byte) []byte {
+	m.h.Reset()
+	m.h.Write(m.binding)
+	for _,p := range parts { m.h.Write(p) }
+	m.sum = m.h.Sum(m.sum[:0])
+	return append(dst[:0],m.sum[:macSize]...)
+}
+func (m *macer) verify(tag []byte,parts ...[]byte) bool {
+	m.tag(nil,parts...)
+	return hmac.Equal(tag,m.sum[:macSize])
+}
+
+// Size of Header.Key
+func macKeyLen(c *CipherObject) int {
+	if c.mode()==mBlock {
+		bz := c.Block.BlockSize()
+		return ((macKeySize+bz-1)/bz)*bz
+	}
+	return macKeySize
+}
+
+// Common state of Reader and SeekReader after the Preamble and Header have been read.
+type head struct {
+	version int
+	codec   Codec
+	codecName string
+	pre     *Preamble
+	header  Header
+	cipher  *CipherObject // The cipher of the current key epoch.
+	base    *CipherObject // The cipher of key epoch 0.
+	epoch   uint64
+	salts   map[uint64][]byte // The salts of the appended key epochs, see Append.
+	origin  int64 // Wrapped streams: the offset of the Header. The Index is relative to it.
+	binding []byte
+	mac     *macer
+	comp    Compressor
+	maxPlain int
+	meta    *Metadata
+	metaRaw []byte // The encrypted Metadata.
+	nonce   []byte
+	ad      []byte
+}
+
+// The maximum size of an encrypted chunk.
+func (h *head) maxRecord() int {
+	if h.header.MaxChunk>math.MaxInt32 { return math.MaxInt32 }
+	n := int(h.header.MaxChunk)
+	switch h.cipher.mode() {
+	case mBlock: n += h.cipher.Block.BlockSize()
+	case mAEAD: n += h.cipher.AEAD.Overhead()
+	}
+	if h.comp!=nil { n++ }
+	if h.header.Padding { n += padTrailer }
+	return n
+}
+
+// Block ciphers only: pads or unpads the last block, as selected by Header.PKCS7.
+func (h *head) padd(lc []byte) {
+	if h.header.PKCS7 { paddPKCS7(lc) } else { padd(lc) }
+}
+func (h *head) unpadd(lb []byte) (int,error) {
+	if h.header.PKCS7 { return unpaddPKCS7(lb) }
+	return unpadd(lb)
+}
+
+/*
+Computes the authentication tag over the Preamble and Header. It directly follows the Header.
+
+For AEAD ciphers, this is the (empty) ciphertext sealed with a reserved nonce,
+otherwise it is a MAC.
+*/
+func (h *head) headerTag() []byte {
+	if h.cipher.mode()==mAEAD {
+		h.nonce = chunkNonce(h.nonce,h.header.Nonce,maxChunks,false)
+		h.ad = append(append(h.ad[:0],headerAD...),h.binding...)
+		return h.cipher.AEAD.Seal(nil,h.nonce,nil,h.ad)
+	}
+	return h.mac.tag(nil,headerAD)
+}
+
+/*
+Reads the magic, the codec, the Preamble and the Header (unless it is a version 0 stream).
+Returns the Decoder for the rest of the stream.
+*/
+func (h *head) parse(rec *recReader,opt *ReaderOptions) (dec Decoder,err error) {
+	rec.limit(opt.MaxPreamble,"Preamble")
+	rec.record()
+	h.version,err = readMagic(rec)
+	if err!=nil { return }
+	if h.version!=0 && h.version!=Version { return nil,UnsupportedVersionError(h.version) }
+	h.codecName,h.codec = DefaultCodec,codecs[DefaultCodec]
+	if h.version!=0 {
+		h.codecName,h.codec,err = readCodec(rec)
+		if err!=nil { return }
+	}
+	pn := len(rec.rec)
+	dec = h.codec.NewDecoder(rec)
+	h.pre = new(Preamble)
+	err = decodePreamble(dec,rec,h.pre,opt)
+	if err!=nil || h.version==0 { return }
+	hn := len(rec.rec)
+	err = decodeHeader(dec,rec,&h.header,opt)
+	if err!=nil { return }
+	raw := rec.stop()
+	err = h.bind(raw[:pn],raw[pn:hn],raw[hn:])
+	return
+}
+
+/*
+Reads the Preamble and Header, starts the decryption and verifies the header tag.
+*/
+func (h *head) read(rec *recReader,decr Decrypter,opt *ReaderOptions) (dec Decoder,err error) {
+	dec,err = h.parse(rec,opt)
+	if err!=nil { return }
+	if h.version==0 { return dec,h.readLegacy(rec,decr,opt) }
+	h.cipher,err = decr.StartDecryption(h.pre)
+	if err!=nil { return nil,&StreamError{Kind:KindKey,Chunk:-1,Err:err} }
+	h.base = h.cipher
+	err = h.header.check(h.cipher)
+	if err!=nil { return }
+	if h.header.Compression!="" {
+		h.comp = compressors[h.header.Compression]
+		if h.comp==nil { return nil,UnknownCompressionError(h.header.Compression) }
+	}
+	h.maxPlain = opt.MaxChunk
+	if h.header.MaxChunk<int64(h.maxPlain) { h.maxPlain = int(h.header.MaxChunk) }
+	switch h.cipher.mode() {
+	case mBlock:
+		key := make([]byte,len(h.header.Key))
+		h.cipher.Block.CryptBlocks(key,h.header.Key)
+		h.mac = newMacer(key,h.binding)
+	case mStream:
+		key := make([]byte,len(h.header.Key))
+		h.cipher.Stream.XORKeyStream(key,h.header.Key)
+		h.mac = newMacer(key,h.binding)
+	}
+	tag,err := decodeBytes(dec,rec,nil,opt.MaxPreamble,"Preamble")
+	if err!=nil { return }
+	if !hmac.Equal(tag,h.headerTag()) { return nil,EHeaderAuth }
+	if h.header.Metadata {
+		err = h.readMetadata(dec,rec,opt)
+		if err!=nil { return }
+	}
+	rec.unlimit()
+	return
+}
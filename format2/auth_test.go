@@ -0,0 +1,65 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "bytes"
+import "errors"
+import "testing"
+
+// Any change to the Preamble, Header or header tag must be detected, before a chunk is decrypted.
+func TestHeaderAuth(t *testing.T) {
+	data := testData(3000)
+	for _,mode := range []int{mAEAD,mBlock,mStream} {
+		ts := &testSuite{Mode:mode}
+		ct := encryptAll(t,ts,nil,data)
+		o := chunkOffsets(t,ts,ct)
+		r,err := newReader(bytes.NewReader(ct),ts,nil)
+		if err!=nil { t.Fatal(err) }
+		
+		tamper := func(name string,at int) {
+			t.Helper()
+			if at<0 { t.Fatalf("mode %d: %s not found",mode,name) }
+			c := append([]byte(nil),ct...)
+			c[at] ^= 1
+			_,err := readAll(ts,c,nil)
+			if !errors.Is(err,EHeaderAuth) { t.Errorf("mode %d, %s: got %v, want EHeaderAuth",mode,name,err) }
+		}
+		// The Encoding follows the PK_Algo, both are "test".
+		tamper("Preamble.Encoding",bytes.LastIndex(ct[:o[0]],[]byte("test")))
+		if mode==mAEAD {
+			tamper("Header.Nonce",bytes.Index(ct,r.header.Nonce))
+		} else {
+			tamper("Header.Key",bytes.Index(ct,r.header.Key))
+		}
+		tamper("header tag",int(o[0])-1)
+		
+		// Every other byte of the head either breaks the framing or the header tag.
+		for i := 0; i<int(o[0]); i++ {
+			c := append([]byte(nil),ct...)
+			c[i] ^= 0x10
+			pt,err := readAll(ts,c,nil)
+			if err==nil || len(pt)!=0 { t.Errorf("mode %d: byte %d of the head changed unnoticed",mode,i) }
+		}
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package format2
+
+import "encoding/binary"
+import "bytes"
+import "io"
+import "math"
+
+/*
+The "binary" codec: a compact, fixed framing without type information.
+All integers are big endian.
+
+	array         [4 bytes] number of elements
+	bool          [1 byte ] 0 or 1
+	uint, int     [8 bytes]
+	string, bytes [4 bytes] length, followed by the content. nil is encoded as empty.
+	nil           not encoded at all
+
+Data records:
+
+	[4 bytes] length of Data, the most significant bit is set for the final chunk,
+	          the next one, if the key epoch follows, the next one, if the salt follows
+	[8 bytes] key epoch, only if it isn't 0
+	[1 byte ] length of Salt, only if it is set
+	[k bytes] Salt
+	[n bytes] Data
+	[1 byte ] length of Tag
+	[m bytes] Tag
+
+As there is no type information, fields, that are unknown to the Reader, can not
+be skipped. Data records can not carry a Nonce (it is never written anyway).
+*/
+type binaryCodec struct{}
+func (binaryCodec) NewEncoder(w io.Writer) Encoder { return &binaryEncoder{w:w} }
+func (binaryCodec) NewDecoder(r io.Reader) Decoder { return &binaryDecoder{r:r} }
+
+const (
+	binaryLast  = 1<<31
+	binaryEpoch = 1<<30
+	binarySalt  = 1<<29
+	binaryMaxData = binarySalt-1
+)
+
+type binaryEncoder struct{
+	w io.Writer
+	b [8]byte
+}
+func (e *binaryEncoder) put(n int) error {
+	_,err := e.w.Write(e.b[:n])
+	return err
+}
+func (e *binaryEncoder) u32(v uint32) error {
+	binary.BigEndian.PutUint32(e.b[:],v)
+	return e.put(4)
+}
+func (e *binaryEncoder) length(n int) error {
+	if n<0 || n>math.MaxUint32 { return EMalformedRecord }
+	return e.u32(uint32(n))
+}
+func (e *binaryEncoder) EncodeArrayLen(n int) error { return e.length(n) }
+func (e *binaryEncoder) EncodeBool(v bool) error {
+	e.b[0] = 0
+	if v { e.b[0] = 1 }
+	return e.put(1)
+}
+func (e *binaryEncoder) EncodeUint(v uint64) error {
+	binary.BigEndian.PutUint64(e.b[:],v)
+	return e.put(8)
+}
+func (e *binaryEncoder) EncodeInt(v int64) error { return e.EncodeUint(uint64(v)) }
+func (e *binaryEncoder) EncodeBytesLen(n int) error { return e.length(n) }
+func (e *binaryEncoder) EncodeBytes(v []byte) error {
+	err := e.length(len(v))
+	if err!=nil { return err }
+	_,err = e.w.Write(v)
+	return err
+}
+func (e *binaryEncoder) EncodeString(v string) error { return e.EncodeBytes([]byte(v)) }
+func (e *binaryEncoder) EncodeNil() error { return nil }
+func (e *binaryEncoder) EncodeData(d *Data) error {
+	if len(d.Nonce)!=0 || len(d.Tag)>math.MaxUint8 || len(d.Salt)>math.MaxUint8 { return EMalformedRecord }
+	if len(d.Data)>binaryMaxData { return EChunkTooLarge }
+	x := uint32(len(d.Data))
+	if d.Last { x |= binaryLast }
+	if d.Epoch!=0 { x |= binaryEpoch }
+	if len(d.Salt)!=0 { x |= binarySalt }
+	err := e.u32(x)
+	if err!=nil { return err }
+	if d.Epoch!=0 {
+		err = e.EncodeUint(d.Epoch)
+		if err!=nil { return err }
+	}
+	if len(d.Salt)!=0 {
+		e.b[0] = byte(len(d.Salt))
+		err = e.put(1)
+		if err==nil { _,err = e.w.Write(d.Salt) }
+		if err!=nil { return err }
+	}
+	_,err = e.w.Write(d.Data)
+	if err!=nil { return err }
+	e.b[0] = byte(len(d.Tag))
+	err = e.put(1)
+	if err!=nil { return err }
+	_,err = e.w.Write(d.Tag)
+	return err
+}
+
+type binaryDecoder struct{
+	r io.Reader
+	b [8]byte
+}
+func (d *binaryDecoder) get(n int) ([]byte,error) {
+	_,err := io.ReadFull(d.r,d.b[:n])
+	return d.b[:n],err
+}
+func (d *binaryDecoder) length() (int,error) {
+	b,err := d.get(4)
+	if err!=nil { return 0,err }
+	n := binary.BigEndian.Uint32(b)
+	if n>math.MaxInt32 { return 0,EMalformedRecord }
+	return int(n),nil
+}
+func (d *binaryDecoder) DecodeArrayLen() (int,error) { return d.length() }
+func (d *binaryDecoder) DecodeBool() (bool,error) {
+	b,err := d.get(1)
+	if err!=nil { return false,err }
+	if b[0]>1 { return false,EMalformedRecord }
+	return b[0]==1,nil
+}
+func (d *binaryDecoder) DecodeUint64() (uint64,error) {
+	b,err := d.get(8)
+	if err!=nil { return 0,err }
+	return binary.BigEndian.Uint64(b),nil
+}
+func (d *binaryDecoder) DecodeInt64() (int64,error) {
+	v,err := d.DecodeUint64()
+	return int64(v),err
+}
+func (d *binaryDecoder) DecodeBytesLen() (int,error) { return d.length() }
+func (d *binaryDecoder) DecodeString() (string,error) {
+	n,err := d.length()
+	if err!=nil { return "",err }
+	// The memory grows with the input, rather than with the length, that is claimed.
+	buf := new(bytes.Buffer)
+	_,err = io.CopyN(buf,d.r,int64(n))
+	if err==io.EOF { err = io.ErrUnexpectedEOF }
+	return buf.String(),err
+}
+func (d *binaryDecoder) Skip() error { return EMalformedRecord }
+func (d *binaryDecoder) DecodeData(dd *Data,check func(n int) error) error {
+	b,err := d.get(4)
+	if err!=nil { return err }
+	x := binary.BigEndian.Uint32(b)
+	dd.Last = x&binaryLast!=0
+	dd.Nonce = dd.Nonce[:0]
+	dd.Epoch = 0
+	if x&binaryEpoch!=0 {
+		dd.Epoch,err = d.DecodeUint64()
+		if err!=nil { return unexpected(err) }
+	}
+	dd.Salt = dd.Salt[:0]
+	if x&binarySalt!=0 {
+		b,err = d.get(1)
+		if err!=nil { return unexpected(err) }
+		dd.Salt = stretch(dd.Salt,int(b[0]))
+		_,err = io.ReadFull(d.r,dd.Salt)
+		if err!=nil { return unexpected(err) }
+	}
+	n := int(x&binaryMaxData)
+	err = check(n)
+	if err!=nil { return err }
+	dd.Data = stretch(dd.Data,n)
+	_,err = io.ReadFull(d.r,dd.Data)
+	if err!=nil { return unexpected(err) }
+	b,err = d.get(1)
+	if err!=nil { return unexpected(err) }
+	dd.Tag = stretch(dd.Tag,int(b[0]))
+	_,err = io.ReadFull(d.r,dd.Tag)
+	return unexpected(err)
+}
+
+// Within a record, the end of the input is unexpected.
+func unexpected(err error) error {
+	if err==io.EOF { return io.ErrUnexpectedEOF }
+	return err
+}
@@ -0,0 +1,96 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "bytes"
+import "io"
+import "io/ioutil"
+import "testing"
+
+func TestBinaryCodec(t *testing.T) {
+	const cs = 1024
+	data := testData(5*cs+100)
+	for _,mode := range []int{mAEAD,mBlock,mStream} {
+		ts := &testSuite{Mode:mode,Next:mode!=mBlock}
+		opt := &WriterOptions{ChunkSize:cs,Codec:"binary",Index:mode!=mBlock,Compression:"flate",Metadata:&Metadata{Name:"x"}}
+		if ts.Next { opt.RekeyChunks = 2 }
+		ct := encryptAll(t,ts,opt,data)
+		if !bytes.HasPrefix(ct,append(append(magic,Version),codecID("binary")...)) { t.Fatalf("mode %d: stream starts with %x",mode,ct[:12]) }
+		info,err := ReadPreamble(bytes.NewReader(ct))
+		if err!=nil || info.Codec!="binary" { t.Errorf("mode %d: %+v, %v",mode,info,err) }
+		
+		r,err := NewReader2(bytes.NewReader(ct),ts,nil)
+		if err!=nil { t.Fatal(err) }
+		if m := r.(*Reader).Metadata(); m==nil || m.Name!="x" { t.Errorf("mode %d: Metadata %+v",mode,m) }
+		pt,err := ioutil.ReadAll(r)
+		if err!=nil || !bytes.Equal(pt,data) { t.Errorf("mode %d: %v",mode,err) }
+		
+		if mode==mBlock { continue }
+		sr,err := NewSeekReader(bytes.NewReader(ct),int64(len(ct)),ts)
+		if err!=nil { t.Fatalf("mode %d: %v",mode,err) }
+		_,err = sr.Seek(3*cs+10,io.SeekStart)
+		if err!=nil { t.Fatal(err) }
+		pt,err = ioutil.ReadAll(sr)
+		if err!=nil || !bytes.Equal(pt,data[3*cs+10:]) { t.Errorf("mode %d: SeekReader: %v",mode,err) }
+	}
+}
+
+// Unknown fields can not be skipped by the binary codec, msgpack skips them.
+func TestBinarySkip(t *testing.T) {
+	h := &Header{Nonce:make([]byte,4),MaxChunk:100,Compression:"flate"}
+	for _,tc := range []struct{
+		codec string
+		extra []byte // An extra field, appended to the Header.
+		err   error
+	}{
+		{"msgpack",[]byte{0xc0},nil},
+		{"binary",[]byte{1},EMalformedRecord},
+	} {
+		c := codecs[tc.codec]
+		raw,err := marshal(c,func(e Encoder) error { return encodeHeader(e,h) })
+		if err!=nil { t.Fatal(err) }
+		// Both codecs start with the array length, which is 9.
+		if tc.codec=="msgpack" { raw[0]++ } else { raw[3]++ }
+		raw = append(raw,tc.extra...)
+		br := bytes.NewReader(raw)
+		var got Header
+		err = decodeHeader(c.NewDecoder(br),br,&got,new(ReaderOptions).defaults())
+		if err!=tc.err { t.Errorf("%s: got %v, want %v",tc.codec,err,tc.err) }
+		if err==nil && (got.MaxChunk!=100 || got.Compression!="flate") { t.Errorf("%s: got %+v",tc.codec,got) }
+	}
+}
+
+func TestUnknownCodec(t *testing.T) {
+	ts := &testSuite{Mode:mAEAD}
+	ct := encryptAll(t,ts,&WriterOptions{Codec:"binary"},testData(100))
+	i := bytes.Index(ct,[]byte("binary"))
+	ct[i+5] = 'x'
+	_,err := readAll(ts,ct,nil)
+	expectError(t,err,UnknownCodecError("binarx"))
+	_,err = ReadPreamble(bytes.NewReader(ct))
+	expectError(t,err,UnknownCodecError("binarx"))
+	
+	_,err = NewWriter2(new(bytes.Buffer),ts,&WriterOptions{Codec:"binarx"})
+	expectError(t,err,UnknownCodecError("binarx"))
+}
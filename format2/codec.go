@@ -0,0 +1,398 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package format2
+
+import "github.com/vmihailenco/msgpack"
+import "bytes"
+import "io"
+
+type UnknownCodecError string
+func (e UnknownCodecError) Error() string { return "Unknown Codec: "+string(e) }
+
+/*
+A wire codec. It encodes the Preamble, the Header and the records of a stream.
+
+Structures are encoded as arrays of their fields, in the order of declaration.
+Data records, which make up most of the stream, have a framing of their own.
+*/
+type Codec interface {
+	NewEncoder(w io.Writer) Encoder
+	
+	// r implements io.ByteScanner. The Decoder must not read ahead, as the raw
+	// bytes, that follow DecodeBytesLen, are read from r directly.
+	NewDecoder(r io.Reader) Decoder
+}
+
+type Encoder interface {
+	EncodeArrayLen(n int) error
+	EncodeBool(v bool) error
+	EncodeUint(v uint64) error
+	EncodeInt(v int64) error
+	EncodeString(v string) error
+	EncodeBytes(v []byte) error
+	EncodeBytesLen(n int) error // Followed by n raw bytes.
+	EncodeNil() error
+	EncodeData(d *Data) error
+}
+
+type Decoder interface {
+	DecodeArrayLen() (int,error) // -1 for nil.
+	DecodeBool() (bool,error)
+	DecodeUint64() (uint64,error)
+	DecodeInt64() (int64,error)
+	DecodeString() (string,error)
+	DecodeBytesLen() (int,error) // -1 for nil, followed by the raw bytes.
+	Skip() error
+	
+	// Decodes a Data record into d, reusing its buffers. check is called with the length
+	// of d.Data, before it is allocated. Returns io.EOF, if the input ends before the record.
+	DecodeData(d *Data,check func(n int) error) error
+}
+
+// The codec of streams, that don't name one.
+const DefaultCodec = "msgpack"
+
+var codecs = map[string]Codec{
+	"msgpack": msgpackCodec{},
+	"binary": binaryCodec{},
+}
+
+func RegisterCodec(name string,c Codec) { codecs[name] = c }
+
+/*
+A stream, that is not encoded with the DefaultCodec, names its codec after the version:
+
+	[1 byte ] 0xC1
+	[1 byte ] length of the name
+	[n bytes] the name, see RegisterCodec
+
+0xC1 is never used by msgpack, so msgpack streams (which start with the Preamble)
+remain unchanged. The codec is part of the binding.
+*/
+const codecMark = 0xc1
+
+func codecID(name string) []byte {
+	if name==DefaultCodec { return nil }
+	return append([]byte{codecMark,byte(len(name))},name...)
+}
+func readCodec(r *recReader) (string,Codec,error) {
+	b,err := r.ReadByte()
+	if err!=nil { return "",nil,err }
+	name := DefaultCodec
+	if b==codecMark {
+		b,err = r.ReadByte()
+		if err!=nil { return "",nil,err }
+		buf := make([]byte,b)
+		_,err = io.ReadFull(r,buf)
+		if err!=nil { return "",nil,err }
+		name = string(buf)
+	} else {
+		r.UnreadByte()
+	}
+	c := codecs[name]
+	if c==nil { return "",nil,UnknownCodecError(name) }
+	return name,c,nil
+}
+
+type sizer int64
+func (s *sizer) Write(p []byte) (int,error) { *s += sizer(len(p)); return len(p),nil }
+
+// Returns the size of the output of f.
+func encodedSize(c Codec,f func(e Encoder) error) int64 {
+	var s sizer
+	f(c.NewEncoder(&s))
+	return int64(s)
+}
+
+func marshal(c Codec,f func(e Encoder) error) ([]byte,error) {
+	buf := new(bytes.Buffer)
+	err := f(c.NewEncoder(buf))
+	return buf.Bytes(),err
+}
+
+/*
+The msgpack codec.
+
+Data is encoded like a struct with the msgpack:",asArray" tag, but the Epoch field
+is omitted, if it is 0, and the Salt field, if it is empty. So the chunks of the first
+key epoch are encoded as before.
+*/
+type msgpackCodec struct{}
+func (msgpackCodec) NewEncoder(w io.Writer) Encoder { return msgpackEncoder{msgpack.NewEncoder(w)} }
+func (msgpackCodec) NewDecoder(r io.Reader) Decoder { return msgpackDecoder{msgpack.NewDecoder(r),r} }
+
+type msgpackEncoder struct{
+	*msgpack.Encoder
+}
+func (e msgpackEncoder) EncodeData(d *Data) (err error) {
+	n := 4
+	if d.Epoch!=0 { n = 5 }
+	if len(d.Salt)!=0 { n = 6 }
+	err = e.EncodeArrayLen(n)
+	if err!=nil { return }
+	err = e.EncodeBool(d.Last)
+	if err!=nil { return }
+	for _,b := range [][]byte{d.Nonce,d.Data,d.Tag} {
+		err = e.EncodeBytes(b)
+		if err!=nil { return }
+	}
+	if n>=5 { err = e.EncodeUint(d.Epoch) }
+	if n==6 && err==nil { err = e.EncodeBytes(d.Salt) }
+	return
+}
+
+type msgpackDecoder struct{
+	*msgpack.Decoder
+	r io.Reader
+}
+func (dec msgpackDecoder) DecodeData(d *Data,check func(n int) error) error {
+	n,err := dec.DecodeArrayLen()
+	if err!=nil { return err }
+	if n<0 { return EMalformedRecord }
+	d.Last = false
+	d.Nonce = d.Nonce[:0]
+	d.Data = d.Data[:0]
+	d.Tag = d.Tag[:0]
+	d.Epoch = 0
+	d.Salt = d.Salt[:0]
+	for i := 0; i<n && err==nil; i++ {
+		switch i {
+		case 0: d.Last,err = dec.DecodeBool()
+		case 1: d.Nonce,err = decodeBytes(dec,dec.r,d.Nonce,recordSlack,"Chunk")
+		case 2:
+			var l int
+			l,err = dec.DecodeBytesLen()
+			if err!=nil { return err }
+			if l<0 { l = 0 }
+			err = check(l)
+			if err!=nil { return err }
+			d.Data = stretch(d.Data,l)
+			_,err = io.ReadFull(dec.r,d.Data)
+		case 3: d.Tag,err = decodeBytes(dec,dec.r,d.Tag,recordSlack,"Chunk")
+		case 4: d.Epoch,err = dec.DecodeUint64()
+		case 5: d.Salt,err = decodeBytes(dec,dec.r,d.Salt,maxSalt,"Chunk")
+		default: err = dec.Skip()
+		}
+	}
+	return err
+}
+
+func encodePreamble(e Encoder,p *Preamble) (err error) {
+	n := 4
+	if p.Wrapped { n = 5 }
+	err = e.EncodeArrayLen(n)
+	if err!=nil { return }
+	err = e.EncodeBytes(p.Opaque)
+	if err!=nil { return }
+	err = e.EncodeString(p.PK_Algo)
+	if err!=nil { return }
+	err = e.EncodeString(p.Encoding)
+	if err!=nil { return }
+	err = e.EncodeArrayLen(len(p.Recipients))
+	for i := 0; i<len(p.Recipients) && err==nil; i++ {
+		rc := &p.Recipients[i]
+		err = e.EncodeArrayLen(3)
+		if err!=nil { return }
+		err = e.EncodeString(rc.PK_Algo)
+		if err!=nil { return }
+		err = e.EncodeBytes(rc.Opaque)
+		if err!=nil { return }
+		err = e.EncodeBytes(rc.Key)
+	}
+	if err==nil && p.Wrapped { err = e.EncodeBool(true) }
+	return
+}
+
+func encodeHeader(e Encoder,h *Header) (err error) {
+	err = e.EncodeArrayLen(9)
+	if err!=nil { return }
+	err = e.EncodeBytes(h.Nonce)
+	if err!=nil { return }
+	err = e.EncodeBytes(h.Key)
+	if err!=nil { return }
+	err = e.EncodeInt(h.MaxChunk)
+	if err!=nil { return }
+	err = e.EncodeString(h.Compression)
+	if err!=nil { return }
+	err = e.EncodeBool(h.Metadata)
+	if err!=nil { return }
+	err = e.EncodeString(h.Signature)
+	if err!=nil { return }
+	err = e.EncodeBytes(h.Signer)
+	if err!=nil { return }
+	err = e.EncodeBool(h.PKCS7)
+	if err!=nil { return }
+	return e.EncodeBool(h.Padding)
+}
+func decodeHeader(dec Decoder,r io.Reader,h *Header,opt *ReaderOptions) (err error) {
+	n,err := dec.DecodeArrayLen()
+	if err!=nil { return }
+	if n<0 { return EHeaderError }
+	for i := 0; i<n && err==nil; i++ {
+		switch i {
+		case 0: h.Nonce,err = decodeBytes(dec,r,nil,opt.MaxPreamble,"Preamble")
+		case 1: h.Key,err = decodeBytes(dec,r,nil,opt.MaxPreamble,"Preamble")
+		case 2: h.MaxChunk,err = dec.DecodeInt64()
+		case 3: h.Compression,err = decodeString(dec,r,opt.MaxPreamble,"Preamble")
+		case 4: h.Metadata,err = dec.DecodeBool()
+		case 5: h.Signature,err = decodeString(dec,r,opt.MaxPreamble,"Preamble")
+		case 6: h.Signer,err = decodeBytes(dec,r,nil,opt.MaxPreamble,"Preamble")
+		case 7: h.PKCS7,err = dec.DecodeBool()
+		case 8: h.Padding,err = dec.DecodeBool()
+		default: err = dec.Skip()
+		}
+	}
+	return
+}
+
+// Encodes a record of byte strings, like the metaRecord and the Trailer.
+func encodeRecord(e Encoder,fields ...[]byte) error {
+	err := e.EncodeArrayLen(len(fields))
+	for i := 0; i<len(fields) && err==nil; i++ { err = e.EncodeBytes(fields[i]) }
+	return err
+}
+
+func encodeIndex(e Encoder,idx *Index) (err error) {
+	n := 2
+	if len(idx.Salt)!=0 { n = 3 }
+	err = e.EncodeArrayLen(n)
+	if err!=nil { return }
+	err = e.EncodeUint(idx.Chunks)
+	if err!=nil { return }
+	err = e.EncodeBytes(idx.Data)
+	if err!=nil || n==2 { return }
+	return e.EncodeBytes(idx.Salt)
+}
+func decodeIndex(dec Decoder,r io.Reader,idx *Index,max int) (err error) {
+	n,err := dec.DecodeArrayLen()
+	if err!=nil { return }
+	if n<0 { return EIndexError }
+	for i := 0; i<n && err==nil; i++ {
+		switch i {
+		case 0: idx.Chunks,err = dec.DecodeUint64()
+		case 1: idx.Data,err = decodeBytes(dec,r,nil,max,"Index")
+		case 2: idx.Salt,err = decodeBytes(dec,r,nil,maxSalt,"Index")
+		default: err = dec.Skip()
+		}
+	}
+	return
+}
+
+func encodeInts(e Encoder,l []int64) error {
+	err := e.EncodeArrayLen(len(l))
+	for i := 0; i<len(l) && err==nil; i++ { err = e.EncodeInt(l[i]) }
+	return err
+}
+func decodeInts(dec Decoder) (l []int64,err error) {
+	n,err := dec.DecodeArrayLen()
+	// Every element consumes input, so n is bounded by the size of the input.
+	for i := 0; i<n && err==nil; i++ {
+		var v int64
+		v,err = dec.DecodeInt64()
+		l = append(l,v)
+	}
+	return
+}
+
+func encodeByteLists(e Encoder,l [][]byte) error {
+	err := e.EncodeArrayLen(len(l))
+	for i := 0; i<len(l) && err==nil; i++ { err = e.EncodeBytes(l[i]) }
+	return err
+}
+func decodeByteLists(dec Decoder,r io.Reader) (l [][]byte,err error) {
+	n,err := dec.DecodeArrayLen()
+	for i := 0; i<n && err==nil; i++ {
+		var v []byte
+		v,err = decodeBytes(dec,r,nil,recordSlack,"Index")
+		l = append(l,v)
+	}
+	return
+}
+
+// The Salts are only encoded, if there are any.
+func encodeIndexBody(e Encoder,x *indexBody) (err error) {
+	n := 5
+	for _,s := range x.Salts { if len(s)!=0 { n = 6 } }
+	err = e.EncodeArrayLen(n)
+	if err!=nil { return }
+	err = encodeInts(e,x.Offsets)
+	if err!=nil { return }
+	err = encodeInts(e,x.Plain)
+	if err!=nil { return }
+	err = e.EncodeInt(x.Size)
+	if err!=nil { return }
+	err = encodeInts(e,x.Cipher)
+	if err!=nil { return }
+	err = encodeInts(e,x.Epochs)
+	if err!=nil || n==5 { return }
+	return encodeByteLists(e,x.Salts)
+}
+func decodeIndexBody(dec Decoder,r io.Reader,x *indexBody) (err error) {
+	n,err := dec.DecodeArrayLen()
+	if err!=nil { return }
+	if n<0 { return EIndexError }
+	for i := 0; i<n && err==nil; i++ {
+		switch i {
+		case 0: x.Offsets,err = decodeInts(dec)
+		case 1: x.Plain,err = decodeInts(dec)
+		case 2: x.Size,err = dec.DecodeInt64()
+		case 3: x.Cipher,err = decodeInts(dec)
+		case 4: x.Epochs,err = decodeInts(dec)
+		case 5: x.Salts,err = decodeByteLists(dec,r)
+		default: err = dec.Skip()
+		}
+	}
+	return
+}
+
+func encodeEntries(e Encoder,l []MetaValue) error {
+	err := e.EncodeArrayLen(len(l))
+	for i := 0; i<len(l) && err==nil; i++ {
+		err = e.EncodeArrayLen(3)
+		if err!=nil { return err }
+		err = e.EncodeString(l[i].Key)
+		if err!=nil { return err }
+		err = e.EncodeBool(l[i].Critical)
+		if err!=nil { return err }
+		err = e.EncodeBytes(l[i].Value)
+	}
+	return err
+}
+func decodeEntries(dec Decoder,r io.Reader,max int) (l []MetaValue,err error) {
+	n,err := dec.DecodeArrayLen()
+	for i := 0; i<n && err==nil; i++ {
+		var v MetaValue
+		var m int
+		m,err = dec.DecodeArrayLen()
+		for j := 0; j<m && err==nil; j++ {
+			switch j {
+			case 0: v.Key,err = decodeString(dec,r,max,"Metadata")
+			case 1: v.Critical,err = dec.DecodeBool()
+			case 2: v.Value,err = decodeBytes(dec,r,nil,max,"Metadata")
+			default: err = dec.Skip()
+			}
+		}
+		l = append(l,v)
+	}
+	return
+}
@@ -0,0 +1,132 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "compress/flate"
+import "bytes"
+import "io"
+import "sync"
+
+type UnknownCompressionError string
+func (e UnknownCompressionError) Error() string { return "Unknown Compression Algorithm: "+string(e) }
+
+/*
+A compression algorithm. Implementations must be safe for concurrent use.
+*/
+type Compressor interface {
+	// Appends the compressed form of src to dst.
+	Compress(dst,src []byte) ([]byte,error)
+	
+	// Appends the decompressed form of src to dst. If the output would exceed max bytes,
+	// it stops and returns LimitError("Decompression").
+	Decompress(dst,src []byte,max int) ([]byte,error)
+}
+
+var compressors = map[string]Compressor{ "flate": new(flateCompressor) }
+
+func RegisterCompression(name string,c Compressor) { compressors[name] = c }
+
+/*
+If compression is enabled, the plaintext of every chunk starts with a flag byte:
+
+	0: The remainder is stored as is. Used, if compression does not pay off.
+	1: The remainder is compressed.
+
+Every chunk is compressed separately, so random access is still possible.
+*/
+const (
+	chunkStored = 0
+	chunkCompressed = 1
+)
+
+// Returns the plaintext of the next chunk, holding n bytes of the buffer.
+func (w *Writer) next(n int) ([]byte,error) {
+	data := w.buffer.Next(n)
+	if w.comp!=nil {
+		var err error
+		w.zbuf,err = w.comp.Compress(append(w.zbuf[:0],chunkCompressed),data)
+		if err!=nil { return nil,err }
+		if len(w.zbuf)>len(data) {
+			w.zbuf = append(append(w.zbuf[:0],chunkStored),data...)
+		}
+		data = w.zbuf
+	}
+	if w.header.Padding { return w.padChunk(data) }
+	return data,nil
+}
+
+// Strips the padding and the flag byte, and decompresses the plaintext of a chunk, if necessary.
+func (h *head) inflate(buf *[]byte,p []byte) ([]byte,error) {
+	if h.header.Padding {
+		var err error
+		p,err = h.unpadChunk(p)
+		if err!=nil { return nil,err }
+	}
+	if h.comp==nil { return p,nil }
+	if len(p)==0 { return nil,EMalformedRecord }
+	switch p[0] {
+	case chunkStored: return p[1:],nil
+	case chunkCompressed:
+		out,err := h.comp.Decompress((*buf)[:0],p[1:],h.maxPlain)
+		if err!=nil { return nil,err }
+		if len(out)>h.maxPlain { return nil,LimitError("Decompression") }
+		*buf = out
+		return out,nil
+	}
+	return nil,EMalformedRecord
+}
+
+// Decrypted chunk in r.temp -> r.buffer
+func (r *Reader) deliver() error {
+	out,err := r.inflate(&r.zbuf,r.temp)
+	if err!=nil { return err }
+	r.buffer.Write(out)
+	for i := range r.zbuf { r.zbuf[i] = 0 }
+	return nil
+}
+
+type flateCompressor struct {
+	pool sync.Pool
+}
+func (f *flateCompressor) Compress(dst,src []byte) ([]byte,error) {
+	b := bytes.NewBuffer(dst)
+	w,_ := f.pool.Get().(*flate.Writer)
+	if w==nil {
+		w,_ = flate.NewWriter(b,flate.DefaultCompression)
+	} else {
+		w.Reset(b)
+	}
+	defer f.pool.Put(w)
+	_,err := w.Write(src)
+	if err!=nil { return nil,err }
+	err = w.Close()
+	return b.Bytes(),err
+}
+func (f *flateCompressor) Decompress(dst,src []byte,max int) ([]byte,error) {
+	b := bytes.NewBuffer(dst)
+	n,err := b.ReadFrom(io.LimitReader(flate.NewReader(bytes.NewReader(src)),int64(max)+1))
+	if err!=nil { return nil,err }
+	if n>int64(max) { return nil,LimitError("Decompression") }
+	return b.Bytes(),nil
+}
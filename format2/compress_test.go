@@ -0,0 +1,100 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "bytes"
+import "crypto/sha256"
+import "errors"
+import "testing"
+
+// Data, that does not compress at all.
+func randomData(n int) []byte {
+	b := make([]byte,0,n+32)
+	h := sha256.Sum256(nil)
+	for len(b)<n {
+		h = sha256.Sum256(h[:])
+		b = append(b,h[:]...)
+	}
+	return b[:n]
+}
+
+func TestCompression(t *testing.T) {
+	const cs = 1024
+	for _,mode := range []int{mAEAD,mBlock,mStream} {
+		ts := &testSuite{Mode:mode}
+		for name,data := range map[string][]byte{
+			"zeros":make([]byte,10*cs),
+			"text":bytes.Repeat([]byte("All work and no play makes Jack a dull boy. "),300),
+			"random":randomData(10*cs+100),
+			"mixed":append(randomData(3*cs),make([]byte,3*cs)...),
+			"empty":nil,
+		} {
+			plain := encryptAll(t,ts,&WriterOptions{ChunkSize:cs},data)
+			ct := encryptAll(t,ts,&WriterOptions{ChunkSize:cs,Compression:"flate"},data)
+			if pt := decryptAll(t,ts,ct); !bytes.Equal(pt,data) { t.Errorf("mode %d, %s: plaintext mismatch",mode,name) }
+			// Chunks, that don't get smaller, cost one byte (and possibly a block) more.
+			chunks := len(data)/cs+1
+			if len(ct)>len(plain)+chunks*17 { t.Errorf("mode %d, %s: %d bytes compressed, %d uncompressed",mode,name,len(ct),len(plain)) }
+			if name=="zeros" && len(ct)>len(plain)/4 { t.Errorf("mode %d, %s: %d bytes compressed, %d uncompressed",mode,name,len(ct),len(plain)) }
+		}
+	}
+	_,err := NewWriter2(new(bytes.Buffer),&testSuite{Mode:mAEAD},&WriterOptions{Compression:"unknown"})
+	if _,ok := err.(UnknownCompressionError); !ok { t.Errorf("got %v, want UnknownCompressionError",err) }
+}
+
+// Compresses every chunk into a bomb, that decompresses to much more than a chunk.
+type bombCompressor struct {
+	flateCompressor
+	bomb []byte
+}
+func (b *bombCompressor) Compress(dst,src []byte) ([]byte,error) { return append(dst,b.bomb...),nil }
+
+func TestDecompressionBomb(t *testing.T) {
+	const cs = 256<<10
+	bomb,err := new(flateCompressor).Compress(nil,make([]byte,16<<20))
+	if err!=nil { t.Fatal(err) }
+	RegisterCompression("test-bomb",&bombCompressor{bomb:bomb})
+	defer delete(compressors,"test-bomb")
+	
+	ts := &testSuite{Mode:mAEAD}
+	data := randomData(cs)
+	for _,tc := range []struct{
+		name string
+		comp string
+		data []byte
+		opt  *ReaderOptions
+	}{
+		// The bomb exceeds the MaxChunk of the Header.
+		{"bomb","test-bomb",data,nil},
+		// A chunk, that is allowed by the Header, exceeds ReaderOptions.MaxChunk.
+		{"MaxChunk","flate",make([]byte,cs),&ReaderOptions{MaxChunk:cs/4}},
+	} {
+		ct := encryptAll(t,ts,&WriterOptions{ChunkSize:cs,Compression:tc.comp},tc.data)
+		var pt []byte
+		n := allocated(func() { pt,err = readAll(ts,ct,tc.opt) })
+		if n>4<<20 { t.Errorf("%s: %d bytes allocated",tc.name,n) }
+		var le LimitError
+		if !errors.As(err,&le) || le!="Decompression" || len(pt)!=0 { t.Errorf("%s: got %d bytes, %v, want LimitError(Decompression)",tc.name,len(pt),err) }
+	}
+}
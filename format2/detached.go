@@ -0,0 +1,127 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "fmt"
+import "bytes"
+import "io"
+import "bufio"
+
+var EBodyMismatch = fmt.Errorf("Body does not belong to the Header")
+
+/*
+Detached streams keep the head (the magic, the codec, the Preamble, the Header, the header tag
+and the Metadata) apart from the body, for instance to store the head in a database and the body
+in a blob store. The head is the same as in attached streams. The body starts with its own magic
+and the binding of the head:
+
+	[3 bytes ] 0xC1 'F' 'B'
+	[1 byte  ] Version
+	[32 bytes] the binding, see makeBinding
+
+It is followed by the records, that follow the head in attached streams. The offsets
+of the Index are relative to the start of the body.
+
+Every chunk is authenticated with the binding, so a body never decrypts with another head. The
+copy of the binding in front of the body lets the Reader reject such a body early, and allows to
+pair heads and bodies without a key (see StreamInfo.Binding and ReadBodyBinding). As the key
+wrapping of Wrapped streams is not bound, the head alone can be passed to Rewrap.
+*/
+var bodyMagic = []byte{0xc1,'F','B'}
+
+// The binding of the stream, see makeBinding. nil for version 0 streams.
+func (h *head) Binding() []byte { return append([]byte(nil),h.binding...) }
+
+/*
+Reads the binding from the start of a detached body.
+*/
+func ReadBodyBinding(body io.Reader) ([]byte,error) {
+	var b [4+32]byte
+	_,err := io.ReadFull(body,b[:])
+	if err!=nil { return nil,err }
+	if !bytes.Equal(b[:3],bodyMagic) { return nil,EBadMagic }
+	if b[3]!=Version { return nil,UnsupportedVersionError(b[3]) }
+	return b[4:],nil
+}
+
+/*
+Like NewWriter2, but writes the head of the stream to hdr, and the body to body.
+The head is written completely before NewDetachedWriter returns.
+
+NOTE: Returns a *Writer object.
+*/
+func NewDetachedWriter(hdr,body io.Writer,enc Encrypter,opt *WriterOptions) (io.WriteCloser,error) {
+	g,err := newWriter(hdr,enc,opt)
+	if err!=nil { return nil,err }
+	err = g.writer.Flush()
+	if err!=nil { return nil,err }
+	g.writer = bufio.NewWriter(body)
+	g.count = &countWriter{Writer:g.writer}
+	g.enc = g.codec.NewEncoder(g.count)
+	g.origin = 0
+	_,err = g.count.Write(append(append(bodyMagic[:len(bodyMagic):len(bodyMagic)],Version),g.binding...))
+	if err!=nil { return nil,err }
+	return g,nil
+}
+
+/*
+Like NewReader2, but reads the head of the stream from hdr, and the body from body.
+A body, that does not belong to the head, is rejected with EBodyMismatch.
+
+NOTE: Returns a *Reader object.
+*/
+func NewDetachedReader(hdr,body io.Reader,decr Decrypter,opt *ReaderOptions) (io.Reader,error) {
+	g,err := newReader(hdr,decr,opt)
+	if err!=nil { return nil,err }
+	if g.version==0 { return nil,headerError(UnsupportedVersionError(0),g.rec) }
+	g.rec = newRecReader(body)
+	err = g.checkBody(g.rec)
+	if err!=nil { return nil,headerError(err,g.rec) }
+	g.dec = g.codec.NewDecoder(g.rec)
+	g.origin = 0
+	return g,nil
+}
+
+/*
+Like NewSeekReader, but reads the head of the stream from hdr. body is the detached body
+of the given size.
+*/
+func NewDetachedSeekReader(hdr io.Reader,body io.ReaderAt,size int64,decr Decrypter) (*SeekReader,error) {
+	g := &SeekReader{src:body,decr:decr,chunk:-1}
+	rec := newRecReader(hdr)
+	_,err := g.head.read(rec,decr,new(ReaderOptions).defaults())
+	if err!=nil { return nil,headerError(err,rec) }
+	err = g.checkBody(io.NewSectionReader(body,0,size))
+	if err!=nil { return nil,err }
+	g.origin = 0
+	return g.open(size)
+}
+
+func (h *head) checkBody(body io.Reader) error {
+	b,err := ReadBodyBinding(body)
+	if err==io.EOF || err==io.ErrUnexpectedEOF { return ETruncated }
+	if err!=nil { return err }
+	if !bytes.Equal(b,h.binding) { return EBodyMismatch }
+	return nil
+}
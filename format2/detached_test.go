@@ -0,0 +1,112 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "bytes"
+import "io"
+import "io/ioutil"
+import "testing"
+
+func detach(t *testing.T,enc Encrypter,opt *WriterOptions,data []byte) (hdr,body []byte) {
+	t.Helper()
+	h,b := new(bytes.Buffer),new(bytes.Buffer)
+	w,err := NewDetachedWriter(h,b,enc,opt)
+	if err!=nil { t.Fatal(err) }
+	if b.Len()!=0 { t.Fatal("body written before the data") }
+	_,err = w.Write(data)
+	if err!=nil { t.Fatal(err) }
+	err = w.Close()
+	if err!=nil { t.Fatal(err) }
+	return h.Bytes(),b.Bytes()
+}
+
+func readDetached(decr Decrypter,hdr,body []byte) ([]byte,error) {
+	r,err := NewDetachedReader(bytes.NewReader(hdr),bytes.NewReader(body),decr,nil)
+	if err!=nil { return nil,err }
+	return ioutil.ReadAll(r)
+}
+
+func TestDetached(t *testing.T) {
+	const cs = 1024
+	data := testData(4*cs+100)
+	for _,mode := range []int{mAEAD,mBlock,mStream} {
+		ts := &testSuite{Mode:mode}
+		opt := &WriterOptions{ChunkSize:cs,Index:mode!=mBlock,Metadata:&Metadata{Name:"x"}}
+		hdr,body := detach(t,ts,opt,data)
+		
+		info,err := ReadPreamble(bytes.NewReader(hdr))
+		if err!=nil { t.Fatal(err) }
+		b,err := ReadBodyBinding(bytes.NewReader(body))
+		if err!=nil || !bytes.Equal(b,info.Binding) { t.Errorf("mode %d: body binding %x, want %x (%v)",mode,b,info.Binding,err) }
+		
+		r,err := NewDetachedReader(bytes.NewReader(hdr),bytes.NewReader(body),ts,nil)
+		if err!=nil { t.Fatal(err) }
+		if m := r.(*Reader).Metadata(); m==nil || m.Name!="x" { t.Errorf("mode %d: Metadata %+v",mode,m) }
+		pt,err := ioutil.ReadAll(r)
+		if err!=nil || !bytes.Equal(pt,data) { t.Errorf("mode %d: %v",mode,err) }
+		
+		// The head and the body together are no attached stream.
+		_,err = readAll(ts,append(append([]byte(nil),hdr...),body...),nil)
+		if err==nil { t.Errorf("mode %d: concatenated stream decrypts",mode) }
+		
+		if mode==mBlock { continue }
+		sr,err := NewDetachedSeekReader(bytes.NewReader(hdr),bytes.NewReader(body),int64(len(body)),ts)
+		if err!=nil { t.Fatalf("mode %d: %v",mode,err) }
+		_,err = sr.Seek(2*cs+10,io.SeekStart)
+		if err!=nil { t.Fatal(err) }
+		pt,err = ioutil.ReadAll(sr)
+		if err!=nil || !bytes.Equal(pt,data[2*cs+10:]) { t.Errorf("mode %d: SeekReader: %v",mode,err) }
+	}
+}
+
+func TestDetachedMismatch(t *testing.T) {
+	const cs = 1024
+	data := testData(3*cs)
+	for _,mode := range []int{mAEAD,mBlock,mStream} {
+		ts := &testSuite{Mode:mode}
+		opt := &WriterOptions{ChunkSize:cs,Index:mode!=mBlock}
+		hdr,body := detach(t,ts,opt,data)
+		_,other := detach(t,ts,opt,data)
+		
+		_,err := readDetached(ts,hdr,other)
+		expectError(t,err,EBodyMismatch)
+		if mode!=mBlock {
+			_,err = NewDetachedSeekReader(bytes.NewReader(hdr),bytes.NewReader(other),int64(len(other)),ts)
+			expectError(t,err,EBodyMismatch)
+		}
+		
+		// A forged binding in front of the body passes the early check, but no chunk decrypts.
+		forged := append(append([]byte(nil),body[:4+32]...),other[4+32:]...)
+		pt,err := readDetached(ts,hdr,forged)
+		expectError(t,err,EAuthError)
+		if len(pt)!=0 { t.Errorf("mode %d: %d bytes delivered from a foreign body",mode,len(pt)) }
+		
+		_,err = readDetached(ts,hdr,body[:20])
+		expectError(t,err,ETruncated)
+		bad := append([]byte(nil),body...)
+		bad[1] ^= 0xff
+		_,err = readDetached(ts,hdr,bad)
+		expectError(t,err,EBadMagic)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package format2
+
+import "fmt"
+import "io"
+
+/*
+The class of a StreamError.
+*/
+type ErrorKind int
+const (
+	// The stream ended early. Retrying with the complete stream may succeed.
+	KindTruncated ErrorKind = iota+1
+	
+	// A chunk, the index or the signature has been tampered with.
+	KindAuth
+	
+	// The framing of the stream is damaged, or it uses unsupported features.
+	KindMalformed
+	
+	// The stream can not be decrypted with the given keys (Decrypter.StartDecryption
+	// failed, or the header tag did not match).
+	KindKey
+	
+	// A limit of ReaderOptions has been exceeded.
+	KindLimit
+	
+	// The underlying reader failed.
+	KindIO
+)
+func (k ErrorKind) String() string {
+	switch k {
+	case KindTruncated: return "truncated"
+	case KindAuth: return "authentication failed"
+	case KindMalformed: return "malformed"
+	case KindKey: return "key error"
+	case KindLimit: return "limit exceeded"
+	case KindIO: return "I/O error"
+	}
+	return fmt.Sprintf("ErrorKind(%d)",int(k))
+}
+
+/*
+The error type returned by Reader. It wraps the cause (see errors.Is and errors.As)
+and records, where in the stream the error happened.
+*/
+type StreamError struct {
+	Kind      ErrorKind
+	
+	// The index of the failing chunk, or -1 if the Preamble or Header was rejected.
+	Chunk     int64
+	
+	// The ciphertext offset of the failing chunk.
+	Offset    int64
+	
+	// The amount of plaintext delivered before the error.
+	Delivered int64
+	
+	Err       error
+}
+func (e *StreamError) Error() string {
+	if e.Chunk<0 { return fmt.Sprintf("format2: %v: %v",e.Kind,e.Err) }
+	return fmt.Sprintf("format2: %v in chunk %d (offset %d): %v",e.Kind,e.Chunk,e.Offset,e.Err)
+}
+func (e *StreamError) Unwrap() error { return e.Err }
+
+func classify(err error,rec *recReader) ErrorKind {
+	switch err {
+	case ETruncated,io.EOF,io.ErrUnexpectedEOF: return KindTruncated
+	case EAuthError,ESignature,ENotSigned: return KindAuth
+	case EHeaderAuth: return KindKey
+	}
+	if _,ok := err.(LimitError); ok { return KindLimit }
+	if rec!=nil && rec.err!=nil && err==rec.err { return KindIO }
+	return KindMalformed
+}
+
+/*
+Wraps an error, that occurred while reading the Preamble or Header.
+*/
+func headerError(err error,rec *recReader) error {
+	if _,ok := err.(*StreamError); ok { return err }
+	return &StreamError{Kind:classify(err,rec),Chunk:-1,Err:err}
+}
+
+/*
+Wraps an error, that occurred while reading the current chunk.
+*/
+func (r *Reader) chunkError(err error) error {
+	return &StreamError{
+		Kind:classify(err,r.rec),
+		Chunk:int64(r.counter),
+		Offset:r.offset,
+		Delivered:r.output,
+		Err:err,
+	}
+}
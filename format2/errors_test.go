@@ -0,0 +1,89 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "bytes"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "strings"
+import "testing"
+
+// Fails with err after n bytes.
+type failReader struct {
+	r   io.Reader
+	n   int
+	err error
+}
+func (f *failReader) Read(p []byte) (int,error) {
+	if f.n<=0 { return 0,f.err }
+	if len(p)>f.n { p = p[:f.n] }
+	m,err := f.r.Read(p)
+	f.n -= m
+	return m,err
+}
+
+func TestStreamError(t *testing.T) {
+	const cs = 1024
+	data := testData(4*cs+cs/2)
+	ts := &testSuite{Mode:mAEAD}
+	ct := encryptAll(t,ts,&WriterOptions{ChunkSize:cs},data)
+	o := chunkOffsets(t,ts,ct)
+	eio := fmt.Errorf("Disk on fire")
+	tamper := func(at int64) []byte {
+		c := append([]byte(nil),ct...)
+		c[at] ^= 1
+		return c
+	}
+	for _,tc := range []struct{
+		name  string
+		r     io.Reader
+		decr  Decrypter
+		opt   *ReaderOptions
+		kind  ErrorKind
+		chunk int64
+		err   error
+	}{
+		{"header",bytes.NewReader(tamper(o[0]-1)),ts,nil,KindKey,-1,EHeaderAuth},
+		{"key",bytes.NewReader(ct),failDecrypter{},nil,KindKey,-1,nil},
+		{"auth",bytes.NewReader(tamper((o[2]+o[3])/2)),ts,nil,KindAuth,2,EAuthError},
+		{"truncated",bytes.NewReader(ct[:o[3]]),ts,nil,KindTruncated,3,ETruncated},
+		{"limit",bytes.NewReader(ct),ts,&ReaderOptions{MaxChunk:cs/2},KindLimit,0,LimitError("Chunk")},
+		{"malformed",bytes.NewReader(append(append([]byte(nil),ct[:o[1]]...),0xc1)),ts,nil,KindMalformed,1,nil},
+		{"I/O",&failReader{r:bytes.NewReader(ct),n:int(o[2])+10,err:eio},ts,nil,KindIO,2,eio},
+	} {
+		r,err := NewReader2(tc.r,tc.decr,tc.opt)
+		if err==nil { _,err = ioutil.ReadAll(r) }
+		var se *StreamError
+		if !errors.As(err,&se) { t.Errorf("%s: got %v, want a *StreamError",tc.name,err); continue }
+		if se.Kind!=tc.kind || se.Chunk!=tc.chunk { t.Errorf("%s: got %v in chunk %d, want %v in chunk %d",tc.name,se.Kind,se.Chunk,tc.kind,tc.chunk) }
+		if tc.err!=nil && !errors.Is(err,tc.err) { t.Errorf("%s: got %v, want %v",tc.name,se.Err,tc.err) }
+		if se.Chunk<0 { continue }
+		if se.Offset!=o[se.Chunk] || se.Delivered!=se.Chunk*cs { t.Errorf("%s: offset %d, %d bytes delivered, want %d, %d",tc.name,se.Offset,se.Delivered,o[se.Chunk],se.Chunk*cs) }
+		if want := fmt.Sprintf("format2: %v in chunk %d (offset %d): ",tc.kind,tc.chunk,o[tc.chunk]); !strings.HasPrefix(se.Error(),want) {
+			t.Errorf("%s: %q",tc.name,se.Error())
+		}
+	}
+}
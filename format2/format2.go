@@ -25,39 +25,106 @@ Wire format 2, Encrypted Preamble File.
 */
 package format2
 
-import "github.com/vmihailenco/msgpack"
 import "fmt"
 import "bytes"
 import "io"
 import "bufio"
-import "math/rand"
+import "crypto/rand"
+import "crypto/subtle"
+import "encoding/binary"
 
 var (
 	EUnknownCipherType = fmt.Errorf("Unknown Cipher Type")
 	EBlockAlignmentError = fmt.Errorf("Block Alignment Error")
 	ENonceError = fmt.Errorf("Nonce Error")
+	ENotSeekable = fmt.Errorf("Cipher Type does not support random access")
+	ETruncated = fmt.Errorf("Truncated Stream: missing final chunk")
+	ECounterOverflow = fmt.Errorf("Chunk Counter Overflow")
+	EChunkSize = fmt.Errorf("Invalid Chunk Size")
+	EChunkTooLarge = fmt.Errorf("Chunk exceeds the maximum Chunk Size")
+	EMalformedRecord = fmt.Errorf("Malformed Record")
+	EClosed = fmt.Errorf("Writer is closed")
 )
 
+// The default value for WriterOptions.ChunkSize
+const DefaultChunkSize = 64<<10
+
+/*
+Nonce of an AEAD chunk:
+
+	[NonceSize()-8 bytes] random prefix, see Header.Nonce
+	[8 bytes            ] chunk counter (big endian), the most significant bit is set for the final chunk
+
+Nonces are never transmitted. A chunk, that is moved to another position,
+fails to authenticate. Chunk counters are below maxChunks, the range above is
+reserved for the Index.
+*/
+const maxChunks = 1<<62
+
+func chunkNonce(nonce,prefix []byte,counter uint64,last bool) []byte {
+	var b [8]byte
+	if last { counter |= 1<<63 }
+	binary.BigEndian.PutUint64(b[:],counter)
+	nonce = append(nonce[:0],prefix...)
+	return append(nonce,b[:]...)
+}
+
+/*
+Associated data of an AEAD chunk:
+
+	[8 bytes ] chunk counter (big endian)
+	[1 byte  ] 1 for the final chunk, 0 otherwise
+	[32 bytes] the binding, see makeBinding
+	[8 bytes ] the key epoch (big endian), only if it isn't 0
+	[n bytes ] Data.Salt, only if it is set
+
+This binds every chunk to its position and makes the final chunk distinguishable,
+so truncated streams are detected. For Block and Stream ciphers, the same bytes
+(without the binding) are fed into the MAC.
+*/
+func chunkAD(ad []byte,counter,epoch uint64,last bool,binding,salt []byte) []byte {
+	var b [9]byte
+	binary.BigEndian.PutUint64(b[:],counter)
+	if last { b[8] = 1 }
+	ad = append(ad[:0],b[:]...)
+	ad = append(ad,binding...)
+	if epoch!=0 {
+		binary.BigEndian.PutUint64(b[:],epoch)
+		ad = append(ad,b[:8]...)
+	}
+	return append(ad,salt...)
+}
+
 func stretch(b []byte,i int) []byte {
 	if cap(b)>=i { return b[:i] }
 	return make([]byte,i)
 }
-func unpadd(lb []byte) int {
-	/*
+/*
+Strips the padding from the last block. Returns the amount of data in lb or EAuthError,
+if the padding is malformed. The time taken does not depend on the content of lb.
+
 	[length] -> padding
 	[1] -> 0
 	[2] -> 0,1
-	[3] -> 0,1,1
-	[3] -> 0,?,2
+	[3] -> 0,2,2
 	...
 	[256]-> 0,...,255
-	*/
-	for {
-		b := int(lb[len(lb)-1])
-		if b==0 { return len(lb)-1 }
-		if len(lb)<=b { return 0 }
-		lb = lb[:len(lb)-b]
+
+padd chains multiple runs for more than 256 bytes of padding, which never happens
+for a single block.
+*/
+func unpadd(lb []byte) (int,error) {
+	n := len(lb)
+	k := int(lb[n-1])
+	z := n-1-k // The position of the 0 byte.
+	good := subtle.ConstantTimeLessOrEq(k+1,n)
+	for i,b := range lb {
+		run := subtle.ConstantTimeLessOrEq(z+1,i)
+		good &= 1^(run&(1^subtle.ConstantTimeByteEq(b,byte(k))))
+		good &= 1^(subtle.ConstantTimeEq(int32(i),int32(z))&(1^subtle.ConstantTimeByteEq(b,0)))
 	}
+	if good!=1 { return 0,EAuthError }
+	return z,nil
 }
 func padd(lc []byte) {
 	if len(lc)==0 { panic("must have at least one byte over") }
@@ -77,167 +144,571 @@ func padd(lc []byte) {
 	}
 }
 
+/*
+PKCS#7 padding, see Header.PKCS7. Every padding byte holds the length of the padding.
+*/
+func paddPKCS7(lc []byte) {
+	for i := range lc { lc[i] = byte(len(lc)) }
+}
+func unpaddPKCS7(lb []byte) (int,error) {
+	n := len(lb)
+	k := int(lb[n-1])
+	good := subtle.ConstantTimeLessOrEq(1,k)&subtle.ConstantTimeLessOrEq(k,n)
+	for i,b := range lb {
+		run := subtle.ConstantTimeLessOrEq(n-k,i)
+		good &= 1^(run&(1^subtle.ConstantTimeByteEq(b,byte(k))))
+	}
+	if good!=1 { return 0,EAuthError }
+	return n-k,nil
+}
+
 type Preamble struct {
 	_msgpack struct{} `msgpack:",asArray"`
 	Opaque []byte
 	PK_Algo  string
 	Encoding string
+	
+	// Multiple recipients: If set, Opaque and PK_Algo are usually empty.
+	Recipients []Recipient
+	
+	// The stream is encrypted with a random content key, that is wrapped by the
+	// recipient stanzas. The key wrapping is not part of the binding, so it can be
+	// replaced without touching the rest of the stream, see Rewrap.
+	Wrapped bool
 }
+
+/*
+A recipient stanza. Every stanza wraps the same content key for a different public key.
+*/
+type Recipient struct {
+	_msgpack struct{} `msgpack:",asArray"`
+	PK_Algo string
+	Opaque  []byte
+	Key     []byte // The wrapped content key.
+}
+
+/*
+The stream header. Follows the Preamble.
+*/
+type Header struct {
+	_msgpack struct{} `msgpack:",asArray"`
+	
+	// AEAD ciphers only: The random nonce prefix of NonceSize()-8 bytes.
+	Nonce []byte
+	
+	// Block and Stream ciphers only: The encrypted MAC key.
+	Key []byte
+	
+	// The maximum amount of plaintext in a single chunk.
+	MaxChunk int64
+	
+	// The compression algorithm, empty for none. See RegisterCompression.
+	Compression string
+	
+	// If true, the encrypted Metadata follows the header tag.
+	Metadata bool
+	
+	// Signed streams only: The signature algorithm and the public key of the signer.
+	Signature string
+	Signer    []byte
+	
+	// Block ciphers only: The chunks are padded with PKCS#7 rather than the format2 padding.
+	PKCS7 bool
+	
+	// If true, the chunks are padded, see closePadded and WriterOptions.Padding.
+	Padding bool
+}
+// Checks, if the header matches the cipher.
+func (h *Header) check(c *CipherObject) error {
+	if h.MaxChunk<=0 { return EHeaderError }
+	if h.PKCS7 && (c.mode()!=mBlock || c.Block.BlockSize()>255) { return EHeaderError }
+	switch c.mode() {
+	case mAEAD:
+		if len(h.Nonce)+8!=c.AEAD.NonceSize() { return ENonceError }
+	case mBlock,mStream:
+		if len(h.Key)!=macKeyLen(c) { return EHeaderError }
+	}
+	return nil
+}
+
 type Data struct {
 	_msgpack struct{} `msgpack:",asArray"`
 	Last  bool
-	Nonce []byte
+	Nonce []byte // Not written anymore: Nonces are derived from the chunk counter.
 	Data  []byte
+	Tag   []byte // Block and Stream ciphers only.
+	Epoch uint64 // The key epoch, see WriterOptions.RekeyChunks.
+	Salt  []byte // The salt of the key epoch, only in the first chunk of an appended one (see Append).
+}
+
+type WriterOptions struct {
+	// If true, the Writer appends a chunk index to the stream, that enables random access.
+	// See NewSeekReader.
+	Index bool
+	
+	// Source of randomness for the stream header. Defaults to crypto/rand.Reader.
+	Random io.Reader
+	
+	// The amount of plaintext per chunk, regardless of the size of the Write calls.
+	// Defaults to DefaultChunkSize. For Block ciphers, it is rounded down to a
+	// multiple of the block size.
+	ChunkSize int
+	
+	// The maximum amount of plaintext per chunk. It is recorded in the Header and
+	// Readers reject larger chunks. Defaults to ChunkSize, must not be smaller.
+	MaxChunkSize int
+	
+	// The compression algorithm ("flate" or any registered one), empty for none.
+	// Chunks, that do not get smaller, are stored uncompressed. Leave it empty for
+	// data, that is known to be incompressible.
+	Compression string
+	
+	// Encrypted and authenticated metadata, readable by Reader.Metadata before the plaintext.
+	Metadata *Metadata
+	
+	// If set, the stream is signed. See Reader.Signer.
+	Signer Signer
+	
+	// Block ciphers only: Use the standard PKCS#7 padding, for interoperability with other tools.
+	// It is ignored for other ciphers.
+	PKCS7 bool
+	
+	// If set, the stream is padded to the size chosen by the policy (PadMultiple, PadPowerOfTwo,
+	// PadPadme or a custom one), so that the ciphertext does not reveal the exact plaintext size.
+	// Every chunk is padded, so the sizes of the records don't reveal it either, and empty
+	// chunks are added before the final one. Chunks emitted by Flush are padded to the full
+	// chunk size. The signature trailer and the Index are not included, but the size of the
+	// Index only depends on the number of chunks.
+	Padding Padding
+	
+	// The content key is replaced by a new one (see CipherObject.Next), whenever
+	// RekeyChunks chunks or RekeyBytes bytes of ciphertext have been encrypted with it.
+	// Zero selects the usage limits of the cipher, derived from its block and nonce size.
+	// A negative value disables the limit. Ciphers without CipherObject.Next are never
+	// rekeyed, their streams have no limits, and explicit positive limits fail with ERekey.
+	RekeyChunks int64
+	RekeyBytes  int64
+	
+	// The wire codec ("msgpack", "binary" or any registered one). Defaults to DefaultCodec.
+	// Readers pick it automatically.
+	Codec string
+}
+
+/*
+Records the bytes read (for the binding) and enforces the limits of ReaderOptions.
+*/
+type recReader struct {
+	*bufio.Reader
+	rec  []byte
+	on   bool
+	left int64
+	what string
+	pos  int64 // The number of bytes consumed.
+	err  error // The last error of the underlying reader, other than io.EOF.
+}
+func newRecReader(r io.Reader) *recReader {
+	rec := &recReader{Reader:bufio.NewReader(r)}
+	rec.unlimit()
+	return rec
+}
+func (r *recReader) record() { r.rec = r.rec[:0]; r.on = true }
+func (r *recReader) stop() []byte { r.on = false; return r.rec }
+func (r *recReader) Read(p []byte) (int,error) {
+	if r.left<=0 { return 0,LimitError(r.what) }
+	if int64(len(p))>r.left { p = p[:r.left] }
+	n,err := r.Reader.Read(p)
+	r.left -= int64(n)
+	r.pos += int64(n)
+	if err!=nil && err!=io.EOF { r.err = err }
+	if r.on { r.rec = append(r.rec,p[:n]...) }
+	return n,err
+}
+func (r *recReader) ReadByte() (byte,error) {
+	if r.left<=0 { return 0,LimitError(r.what) }
+	b,err := r.Reader.ReadByte()
+	if err==nil { r.left--; r.pos++ }
+	if err!=nil && err!=io.EOF { r.err = err }
+	if r.on && err==nil { r.rec = append(r.rec,b) }
+	return b,err
+}
+func (r *recReader) UnreadByte() error {
+	err := r.Reader.UnreadByte()
+	if err==nil { r.left++; r.pos-- }
+	if r.on && err==nil { r.rec = r.rec[:len(r.rec)-1] }
+	return err
+}
+
+type countWriter struct {
+	*bufio.Writer
+	n int64
+}
+func (c *countWriter) Write(p []byte) (int,error) {
+	n,err := c.Writer.Write(p)
+	c.n += int64(n)
+	return n,err
+}
+func (c *countWriter) WriteByte(b byte) error {
+	err := c.Writer.WriteByte(b)
+	if err==nil { c.n++ }
+	return err
+}
+func (c *countWriter) WriteString(s string) (int,error) {
+	n,err := c.Writer.WriteString(s)
+	c.n += int64(n)
+	return n,err
 }
 
 type Writer struct {
-	enc    *msgpack.Encoder
+	head
+	enc    Encoder
 	writer *bufio.Writer
-	cipher *CipherObject
+	count  *countWriter
 	cached Data
 	buffer bytes.Buffer
-	coder  func(*Writer,bool) error
+	coder  func(*Writer,int,bool) error
 	errcd  error
-	random rand.Source
-}
-func (w *Writer) randomize() {
-	m := 0
-	var e uint64
-	for i := range w.cached.Nonce {
-		if m==0 {
-			e = uint64(w.random.Int63())*3
-			m+= 8
-		}
-		w.cached.Nonce[i] ^= byte(e)
-		e>>=8
-		m--
-	}
+	plain  int64
+	index  *indexBody
+	counter uint64
+	chunk  int
+	zbuf   []byte
+	signer Signer
+	sign   *signState
+	padding Padding
+	resume uint64 // Append: the counter of the chunk after the rewritten one, see Append.
+	salt   []byte // Append: the salt of the key epoch, that the next chunk starts.
+	fill   int    // The size of the final padded chunk, see closePadded.
+	pbuf   []byte // The padded plaintext of a chunk.
+	zero   []byte
+	rekey  rekeyState
 }
-func wBlock(w *Writer,last bool) error {
+/*
+The coders encrypt the next n bytes of w.buffer into a single chunk.
+For Block ciphers, n must be a multiple of the block size, unless it is the final chunk
+or compression is enabled. In these cases, the chunk is padded.
+*/
+func wBlock(w *Writer,n int,last bool) error {
+	err := w.rotate(n)
+	if err!=nil { return err }
 	bz := w.cipher.Block.BlockSize()
-	l := w.buffer.Len()
-	if l>=bz {
-		L := l - (l%bz)
-		data := w.buffer.Next(L)
-		w.cached.Data = stretch(w.cached.Data,len(data))
-		w.cached.Last = false
-		w.cached.Nonce = nil
-		w.cipher.Block.CryptBlocks(w.cached.Data,data)
-		err := w.enc.Encode(&w.cached)
-		if err!=nil { return err }
-	}
-	if last {
-		l = w.buffer.Len()
-		lb := make([]byte,bz)
-		copy(lb,w.buffer.Next(l))
-		padd(lb[l:])
-		w.cached.Data = stretch(w.cached.Data,len(lb))
-		w.cached.Last = true
-		w.cached.Nonce = nil
-		w.cipher.Block.CryptBlocks(w.cached.Data,lb)
-		return w.enc.Encode(&w.cached)
-	}
-	return nil
+	data,err := w.next(n)
+	if err!=nil { return err }
+	l := len(data)
+	pad := last || w.comp!=nil || w.header.Padding
+	if pad { l = (l/bz+1)*bz }
+	w.cached.Data = stretch(w.cached.Data,l)
+	copy(w.cached.Data,data)
+	if pad { w.padd(w.cached.Data[len(data):]) }
+	w.cached.Last = last
+	w.cached.Nonce = nil
+	w.cached.Epoch = w.epoch
+	w.cached.Salt = w.salt
+	w.cipher.Block.CryptBlocks(w.cached.Data,w.cached.Data)
+	w.ad = chunkAD(w.ad,w.counter,w.epoch,last,nil,w.salt)
+	w.cached.Tag = w.mac.tag(w.cached.Tag,w.ad,w.cached.Data)
+	return w.emit(n)
 }
-func wStream(w *Writer,last bool) error {
-	data := w.buffer.Next(w.buffer.Len())
+func wStream(w *Writer,n int,last bool) error {
+	err := w.rotate(n)
+	if err!=nil { return err }
+	data,err := w.next(n)
+	if err!=nil { return err }
 	w.cached.Data = stretch(w.cached.Data,len(data))
-	w.cached.Last = false
+	w.cached.Last = last
 	w.cached.Nonce = nil
+	w.cached.Epoch = w.epoch
+	w.cached.Salt = w.salt
 	w.cipher.Stream.XORKeyStream(w.cached.Data,data)
-	return w.enc.Encode(&w.cached)
+	w.ad = chunkAD(w.ad,w.counter,w.epoch,last,nil,w.salt)
+	w.cached.Tag = w.mac.tag(w.cached.Tag,w.ad,w.cached.Data)
+	return w.emit(n)
 }
-func wAEAD(w *Writer,last bool) error {
-	nz := w.cipher.AEAD.NonceSize()
+func wAEAD(w *Writer,n int,last bool) error {
 	oh := w.cipher.AEAD.Overhead()
-	if len(w.cached.Nonce)<=nz {
-		w.cached.Nonce = make([]byte,nz)
-	}
-	w.randomize()
-	data := w.buffer.Next(w.buffer.Len())
+	if w.counter>=maxChunks { return ECounterOverflow }
+	err := w.rotate(n)
+	if err!=nil { return err }
+	data,err := w.next(n)
+	if err!=nil { return err }
 	w.cached.Data = stretch(w.cached.Data,len(data)+oh)
-	w.cached.Last = false
-	w.cached.Data = w.cipher.AEAD.Seal(w.cached.Data[:0],w.cached.Nonce[:nz],data,w.cached.Nonce[nz:])
-	return w.enc.Encode(&w.cached)
+	w.cached.Last = last
+	w.cached.Nonce = nil
+	w.cached.Epoch = w.epoch
+	w.cached.Salt = w.salt
+	w.nonce = chunkNonce(w.nonce,w.header.Nonce,w.counter,last)
+	w.ad = chunkAD(w.ad,w.counter,w.epoch,last,w.binding,w.salt)
+	w.cached.Data = w.cipher.AEAD.Seal(w.cached.Data[:0],w.nonce,data,w.ad)
+	return w.emit(n)
+}
+
+// Encodes w.cached, which holds 'plain' bytes of plaintext.
+func (w *Writer) emit(plain int) error {
+	if w.index!=nil {
+		w.index.Offsets = append(w.index.Offsets,w.count.n-w.origin)
+		w.index.Plain   = append(w.index.Plain,w.plain)
+		w.index.Cipher  = append(w.index.Cipher,w.index.cpos)
+		w.index.cpos += int64(len(w.cached.Data))
+	}
+	if w.sign!=nil { w.sign.chunk(w.counter,&w.cached) }
+	w.plain += int64(plain)
+	w.counter++
+	w.rekey.chunks++
+	w.rekey.bytes += int64(len(w.cached.Data))
+	w.salt = nil
+	return w.enc.EncodeData(&w.cached)
 }
 
 /*
 NOTE: Returns a *Writer object.
 */
 func NewWriter(w io.Writer, enc Encrypter) (io.WriteCloser,error){
+	return NewWriter2(w,enc,nil)
+}
+
+/*
+Like NewWriter, but with options. opt may be nil.
+
+NOTE: Returns a *Writer object.
+*/
+func NewWriter2(w io.Writer, enc Encrypter, opt *WriterOptions) (io.WriteCloser,error){
+	g,err := newWriter(w,enc,opt)
+	if err!=nil { return nil,err }
+	return g,nil
+}
+
+// Writes the head of a stream (up to the Metadata) to w, and returns the Writer for the rest.
+func newWriter(w io.Writer, enc Encrypter, opt *WriterOptions) (*Writer,error){
+	if opt==nil { opt = new(WriterOptions) }
+	random := opt.Random
+	if random==nil { random = rand.Reader }
+	chunk := opt.ChunkSize
+	if chunk==0 { chunk = DefaultChunkSize }
+	if chunk<0 || (opt.MaxChunkSize!=0 && opt.MaxChunkSize<chunk) { return nil,EChunkSize }
+	cname := opt.Codec
+	if cname=="" { cname = DefaultCodec }
+	codec := codecs[cname]
+	if codec==nil || len(cname)>255 { return nil,UnknownCodecError(cname) }
 	bw := bufio.NewWriter(w)
 	pre,ciph,err := enc.StartEncryption()
 	if err!=nil { return nil,err }
 	g := &Writer{
-		enc: msgpack.NewEncoder(bw),
 		writer:bw,
-		cipher:ciph,
+		count:&countWriter{Writer:bw},
 	}
-	err = g.enc.Encode(pre)
-	if err!=nil { return nil,err }
+	g.pre = pre
+	g.cipher = ciph
+	g.base = ciph
+	g.codec,g.codecName = codec,cname
+	g.enc = codec.NewEncoder(g.count)
+	var key []byte
 	switch ciph.mode() {
-	case mBlock: g.coder = wBlock
-	case mStream: g.coder = wStream
+	case mBlock,mStream:
+		if ciph.mode()==mBlock {
+			g.coder = wBlock
+		} else {
+			g.coder = wStream
+		}
+		key = make([]byte,macKeyLen(ciph))
+		_,err = io.ReadFull(random,key)
+		if err!=nil { return nil,err }
+		g.header.Key = make([]byte,len(key))
+		if ciph.mode()==mBlock {
+			ciph.Block.CryptBlocks(g.header.Key,key)
+		} else {
+			ciph.Stream.XORKeyStream(g.header.Key,key)
+		}
 	case mAEAD:
 		g.coder = wAEAD
-		g.random = rand.NewSource(rand.Int63())
+		nz := ciph.AEAD.NonceSize()
+		if nz<8 { return nil,ENonceError }
+		g.header.Nonce = make([]byte,nz-8)
+		_,err = io.ReadFull(random,g.header.Nonce)
+		if err!=nil { return nil,err }
 	default: return nil,EUnknownCipherType
 	}
+	if opt.Index {
+		if ciph.mode()==mBlock { return nil,ENotSeekable }
+		g.index = new(indexBody)
+	}
+	g.header.Metadata = opt.Metadata!=nil
+	g.header.PKCS7 = opt.PKCS7 && ciph.mode()==mBlock
+	g.header.Padding = opt.Padding!=nil
+	g.padding = opt.Padding
+	if g.header.PKCS7 && ciph.Block.BlockSize()>255 { return nil,EBlockAlignmentError }
+	err = g.setupRekey(opt)
+	if err!=nil { return nil,err }
+	if opt.Signer!=nil {
+		g.signer = opt.Signer
+		g.header.Signature = opt.Signer.SignatureAlgo()
+		g.header.Signer = opt.Signer.SignerKey()
+	}
+	if opt.Compression!="" {
+		g.comp = compressors[opt.Compression]
+		if g.comp==nil { return nil,UnknownCompressionError(opt.Compression) }
+		g.header.Compression = opt.Compression
+	}
+	if ciph.mode()==mBlock {
+		bz := ciph.Block.BlockSize()
+		chunk -= chunk%bz
+		if chunk==0 { chunk = bz }
+	}
+	g.chunk = chunk
+	g.header.MaxChunk = int64(chunk)
+	if opt.MaxChunkSize!=0 { g.header.MaxChunk = int64(opt.MaxChunkSize) }
+	
+	prefix := append(append(magic[:len(magic):len(magic)],Version),codecID(cname)...)
+	pb,err := marshal(codec,func(e Encoder) error { return encodePreamble(e,pre) })
+	if err!=nil { return nil,err }
+	hdr,err := marshal(codec,func(e Encoder) error { return encodeHeader(e,&g.header) })
+	if err!=nil { return nil,err }
+	err = g.bind(prefix,pb,hdr)
+	if err!=nil { return nil,err }
+	raw := append(append(prefix,pb...),hdr...)
+	if key!=nil { g.mac = newMacer(key,g.binding) }
+	_,err = g.count.Write(raw)
+	if err!=nil { return nil,err }
+	err = g.enc.EncodeBytes(g.headerTag())
+	if err!=nil { return nil,err }
+	if opt.Metadata!=nil {
+		err = g.writeMetadata(opt.Metadata)
+		if err!=nil { return nil,err }
+	}
+	if g.signer!=nil { g.sign = newSignState(g.binding,g.metaRaw) }
 	return g,nil
 }
 
+/*
+Buffers p and emits a chunk whenever there are more than ChunkSize bytes.
+At most one chunk is kept in memory, so the final chunk is never empty,
+unless the whole stream is.
+*/
 func (w *Writer) Write(p []byte) (n int, err error) {
-	if w.errcd!=nil { return 0,w.errcd }
-	w.buffer.Write(p)
-	e := w.coder(w,false)
-	if e!=nil { w.errcd = e }
-	return len(p),nil
+	for len(p)>0 {
+		if w.errcd!=nil { return n,w.errcd }
+		if w.buffer.Len()==w.chunk {
+			w.errcd = w.coder(w,w.chunk,false)
+			continue
+		}
+		m := w.chunk-w.buffer.Len()
+		if m>len(p) { m = len(p) }
+		w.buffer.Write(p[:m])
+		n += m
+		p = p[m:]
+	}
+	return
 }
+
+/*
+Emits the buffered data as a chunk and flushes the underlying writer, so
+the receiver can decrypt everything written so far. Useful for interactive protocols.
+
+For Block ciphers without compression, a trailing partial block remains buffered.
+*/
+func (w *Writer) Flush() error {
+	if w.errcd!=nil { return w.errcd }
+	n := w.buffer.Len()
+	if w.cipher.mode()==mBlock && w.comp==nil { n -= n%w.cipher.Block.BlockSize() }
+	if n>0 {
+		w.errcd = w.coder(w,n,false)
+		if w.errcd!=nil { return w.errcd }
+	}
+	return w.writer.Flush()
+}
+/*
+Emits the final chunk and everything following it. Afterwards, Write, Flush and Close
+fail with EClosed. If Close fails, the stream is unusable, and so is the Writer.
+*/
 func (w *Writer) Close() error {
-	err := w.coder(w,true)
+	if w.errcd!=nil { return w.errcd }
+	w.errcd = w.close()
+	if w.errcd!=nil { return w.errcd }
+	w.errcd = EClosed
+	return nil
+}
+func (w *Writer) close() error {
+	var err error
+	// The rewritten chunk of Append must not be the final one again.
+	if w.counter<w.resume {
+		err = w.coder(w,w.buffer.Len(),false)
+		if err!=nil { return err }
+	}
+	if w.padding!=nil {
+		err = w.closePadded()
+	} else {
+		err = w.coder(w,w.buffer.Len(),true)
+	}
 	if err!=nil { return err }
+	if w.sign!=nil {
+		err = w.writeTrailer()
+		if err!=nil { return err }
+	}
+	if w.index!=nil {
+		err = w.writeIndex()
+		if err!=nil { return err }
+	}
 	return w.writer.Flush()
 }
 
 type Reader struct {
-	dec    *msgpack.Decoder
-	cipher *CipherObject
+	head
+	dec    Decoder
+	rec    *recReader
+	opt    *ReaderOptions
+	output int64
+	offset int64
 	cached Data
 	buffer bytes.Buffer
 	temp   []byte
+	zbuf   []byte
 	coder  func(*Reader) error
 	errcd  error
+	last   bool
+	counter uint64
+	sign   *signState
+	verifier Verifier
+	signed bool
 }
 func rBlock(r *Reader) error {
 	if (len(r.cached.Data)%r.cipher.Block.BlockSize())!=0 {
 		return EBlockAlignmentError
 	}
+	r.ad = chunkAD(r.ad,r.counter,r.epoch,r.cached.Last,nil,r.cached.Salt)
+	if !r.mac.verify(r.cached.Tag,r.ad,r.cached.Data) { return EAuthError }
 	r.temp = stretch(r.temp,len(r.cached.Data))
 	r.cipher.Block.CryptBlocks(r.temp,r.cached.Data)
-	if r.cached.Last && len(r.temp)!=0 {
+	if (r.cached.Last || r.comp!=nil || r.header.Padding) && len(r.temp)!=0 {
 		sz := len(r.temp)-r.cipher.Block.BlockSize()
-		r.temp = r.temp[:sz+unpadd(r.temp[sz:])]
+		n,err := r.unpadd(r.temp[sz:])
+		if err!=nil {
+			for i := range r.temp { r.temp[i] = 0 }
+			return err
+		}
+		r.temp = r.temp[:sz+n]
 	}
-	r.buffer.Write(r.temp)
+	err := r.deliver()
 	for i := range r.temp { r.temp[i] = 0 }
-	return nil
+	return err
 }
 func rStream(r *Reader) error {
+	r.ad = chunkAD(r.ad,r.counter,r.epoch,r.cached.Last,nil,r.cached.Salt)
+	if !r.mac.verify(r.cached.Tag,r.ad,r.cached.Data) { return EAuthError }
 	r.temp = stretch(r.temp,len(r.cached.Data))
 	r.cipher.Stream.XORKeyStream(r.temp,r.cached.Data)
-	r.buffer.Write(r.temp)
+	err := r.deliver()
 	for i := range r.temp { r.temp[i] = 0 }
-	return nil
+	return err
 }
 func rAEAD(r *Reader) error {
-	nz := r.cipher.AEAD.NonceSize()
-	//oh := r.cipher.AEAD.Overhead()
-	if len(r.cached.Nonce)<nz { return ENonceError }
+	if r.counter>=maxChunks { return ECounterOverflow }
 	r.temp = stretch(r.temp,len(r.cached.Data))
 	var err error
-	r.temp,err = r.cipher.AEAD.Open(r.temp[:0],r.cached.Nonce[:nz],r.cached.Data,r.cached.Nonce[nz:])
+	r.nonce = chunkNonce(r.nonce,r.header.Nonce,r.counter,r.cached.Last)
+	r.ad = chunkAD(r.ad,r.counter,r.epoch,r.cached.Last,r.binding,r.cached.Salt)
+	r.temp,err = r.cipher.AEAD.Open(r.temp[:0],r.nonce,r.cached.Data,r.ad)
 	if err==nil {
-		r.buffer.Write(r.temp)
+		err = r.deliver()
+	} else {
+		err = EAuthError
 	}
 	for i := range r.temp { r.temp[i] = 0 }
 	return err
@@ -246,19 +717,44 @@ func rAEAD(r *Reader) error {
 NOTE: Returns a *Reader object.
 */
 func NewReader(r io.Reader,decr Decrypter) (io.Reader,error) {
+	return NewReader2(r,decr,nil)
+}
+
+/*
+Like NewReader, but with limits. opt may be nil, in which case the defaults apply.
+If a limit is exceeded, a LimitError is returned.
+
+NOTE: Returns a *Reader object.
+*/
+func NewReader2(r io.Reader,decr Decrypter,opt *ReaderOptions) (io.Reader,error) {
+	g,err := newReader(r,decr,opt)
+	if err!=nil { return nil,err }
+	return g,nil
+}
+
+// Reads the head of a stream (up to the Metadata) from r, and returns the Reader for the rest.
+func newReader(r io.Reader,decr Decrypter,opt *ReaderOptions) (*Reader,error) {
+	rec := newRecReader(r)
 	g := &Reader{
-		dec:msgpack.NewDecoder(bufio.NewReader(r)),
+		rec:rec,
+		opt:opt.defaults(),
 	}
-	p := new(Preamble)
-	err := g.dec.Decode(p)
-	if err!=nil { return nil,err }
-	g.cipher,err = decr.StartDecryption(p)
-	if err!=nil { return nil,err }
+	var err error
+	g.dec,err = g.head.read(rec,decr,g.opt)
+	if err!=nil { return nil,headerError(err,rec) }
+	if g.header.Signature!="" {
+		g.verifier = verifiers[g.header.Signature]
+		if g.verifier==nil { return nil,headerError(UnknownSignatureError(g.header.Signature),rec) }
+		g.sign = newSignState(g.binding,g.metaRaw)
+	} else if g.opt.RequireSignature {
+		return nil,headerError(ENotSigned,rec)
+	}
+	legacy := g.version==0
 	switch g.cipher.mode() {
-	case mBlock: g.coder = rBlock
-	case mStream: g.coder = rStream
-	case mAEAD: g.coder = rAEAD
-	default: return nil,EUnknownCipherType
+	case mBlock: g.coder = rBlock; if legacy { g.coder = rLegacyBlock }
+	case mStream: g.coder = rStream; if legacy { g.coder = rLegacyStream }
+	case mAEAD: g.coder = rAEAD; if legacy { g.coder = rLegacyAEAD }
+	default: return nil,headerError(EUnknownCipherType,rec)
 	}
 	return g,nil
 }
@@ -266,18 +762,40 @@ func (r *Reader) Read(p []byte) (n int, err error) {
 	m,_ := r.buffer.Read(p)
 	if m>0 {
 		n+=m
-		p = p[:m]
+		p = p[m:]
 	}
 	for len(p)>0 {
 		if r.errcd!=nil { err = r.errcd ; return }
-		err := r.dec.Decode(&r.cached)
-		if err!=nil { r.errcd = err ; continue }
+		if r.last { r.errcd = io.EOF ; continue }
+		r.offset = r.rec.pos
+		err := r.decodeData()
+		// Version 0 streams end without a final chunk.
+		if err==io.EOF && r.version==0 { r.errcd = err ; continue }
+		if err==io.EOF || err==io.ErrUnexpectedEOF { err = ETruncated }
+		if err!=nil { r.errcd = r.chunkError(err) ; continue }
+		if r.version==0 && r.cached.Epoch!=0 { err = EMalformedRecord }
+		if err==nil { err = r.follow(r.cached.Epoch,r.cached.Salt) }
+		if err!=nil { r.errcd = r.chunkError(err) ; continue }
+		if r.sign!=nil { r.sign.chunk(r.counter,&r.cached) }
 		err = r.coder(r)
-		if err!=nil { r.errcd = err ; continue }
+		if err!=nil { r.buffer.Reset() ; r.errcd = r.chunkError(err) ; continue }
+		// The final chunk is only delivered, if the signature is valid.
+		if r.cached.Last && r.sign!=nil {
+			err = r.readTrailer()
+			if err!=nil { r.buffer.Reset() ; r.errcd = r.chunkError(err) ; continue }
+		}
+		if r.opt.MaxOutput>0 && r.output+int64(r.buffer.Len())>r.opt.MaxOutput {
+			r.buffer.Reset()
+			r.errcd = r.chunkError(LimitError("Output"))
+			continue
+		}
+		r.output += int64(r.buffer.Len())
+		r.last = r.cached.Last
+		r.counter++
 		m,_ := r.buffer.Read(p)
 		if m>0 {
 			n+=m
-			p = p[:m]
+			p = p[m:]
 		}
 	}
 	return
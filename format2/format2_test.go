@@ -0,0 +1,44 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "bytes"
+import "testing"
+
+// After Close, the Writer must not emit anything else.
+func TestCloseTwice(t *testing.T) {
+	ts := &testSuite{Mode:mAEAD}
+	buf := new(bytes.Buffer)
+	w,err := NewWriter2(buf,ts,&WriterOptions{Index:true})
+	if err!=nil { t.Fatal(err) }
+	_,err = w.Write(testData(100))
+	if err!=nil { t.Fatal(err) }
+	err = w.Close()
+	if err!=nil { t.Fatal(err) }
+	n := buf.Len()
+	if err = w.Close(); err!=EClosed { t.Fatalf("Close: got %v, want EClosed",err) }
+	if _,err = w.Write([]byte{1}); err!=EClosed { t.Fatalf("Write: got %v, want EClosed",err) }
+	if err = w.(*Writer).Flush(); err!=EClosed { t.Fatalf("Flush: got %v, want EClosed",err) }
+	if buf.Len()!=n { t.Fatal("Writer emitted data after Close") }
+}
@@ -0,0 +1,422 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package format2
+
+import "crypto/aes"
+import "crypto/cipher"
+import "encoding/binary"
+import "fmt"
+import "bytes"
+import "io"
+import "math"
+import "bufio"
+import "sort"
+import "sync"
+
+var (
+	ENoIndex = fmt.Errorf("Stream has no Index")
+	EIndexError = fmt.Errorf("Malformed Index")
+	ESeekError = fmt.Errorf("Seek to negative Position")
+)
+
+const footerSize = 16
+var footerMagic = []byte("F2-INDEX")
+var indexAD = []byte("format2-index")
+
+/*
+The Index of a seekable stream. It follows the last Data record (the one with Last=true)
+and is itself followed by a fixed-size footer:
+
+	[8 bytes] Offset of the Index record (big endian)
+	[8 bytes] "F2-INDEX"
+
+The Data field is sealed (see indexCipher), so the Index reveals nothing but the number of
+chunks. Its nonce is derived from the number of chunks in a separate counter range
+(see indexCounter), so the Chunks field is authenticated as well. Appending to a stream
+changes the number of chunks, but two appends to the same state of a file may end with the
+same number, so the key of the Index is derived from the salt of the last append.
+*/
+type Index struct {
+	_msgpack struct{} `msgpack:",asArray"`
+	Chunks uint64
+	Data   []byte
+	Salt   []byte // The salt of the last append (see Append), only if there is one.
+}
+
+func indexCounter(chunks uint64) uint64 { return maxChunks|chunks }
+
+func (h *head) indexAD(chunks uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:],chunks)
+	h.ad = append(append(append(h.ad[:0],indexAD...),b[:]...),h.binding...)
+	return h.ad
+}
+
+var indexKeyLabel = []byte("format2-index-key")
+
+/*
+Returns the AEAD, that seals the Index, and the prefix of its nonce.
+
+AEAD ciphers use the cipher of key epoch 0. Block and Stream ciphers have no authentication
+of their own, and the key stream can not be positioned behind the last chunk without
+decrypting the stream, so they use AES-256-GCM with a subkey of the MAC key (see macer.derive) and a
+zero nonce prefix. The MAC key is unique to the stream, and so are the nonces within it.
+
+Appended streams mix the salt of the last append into the key: AEAD ciphers use the
+cipher, that CipherObject.Next derives from epoch 0 with the label and the salt.
+*/
+func (h *head) indexCipher(salt []byte) (cipher.AEAD,[]byte,error) {
+	label := append(append([]byte(nil),indexKeyLabel...),salt...)
+	if h.base.mode()==mAEAD {
+		if len(salt)==0 { return h.base.AEAD,h.header.Nonce,nil }
+		if h.base.Next==nil { return nil,nil,ERekey }
+		c,err := h.base.Next(label)
+		if err!=nil { return nil,nil,err }
+		if c.mode()!=mAEAD { return nil,nil,EUnknownCipherType }
+		return c.AEAD,h.header.Nonce,nil
+	}
+	b,err := aes.NewCipher(h.mac.derive(label))
+	if err!=nil { return nil,nil,err }
+	a,err := cipher.NewGCM(b)
+	if err!=nil { return nil,nil,err }
+	return a,make([]byte,a.NonceSize()-8),nil
+}
+type indexBody struct {
+	_msgpack struct{} `msgpack:",asArray"`
+	Offsets []int64 // Byte offset of every Data record (relative to the Header for Wrapped streams).
+	Plain   []int64 // Plaintext offset of every Data record.
+	Size    int64   // Total plaintext size.
+	Cipher  []int64 // Ciphertext offset of every Data record, that is the key stream position for Stream ciphers.
+	Epochs  []int64 // The first Data record of every key epoch, except the first one (see rekeyState).
+	Salts   [][]byte // The salt of every key epoch in Epochs, empty unless it is appended. Optional.
+	
+	cpos    int64
+	salt    []byte // Index.Salt
+}
+
+func (w *Writer) writeIndex() error {
+	w.index.Size = w.plain
+	body,err := marshal(w.codec,func(e Encoder) error { return encodeIndexBody(e,w.index) })
+	if err!=nil { return err }
+	if w.header.Padding {
+		// The encoded sizes of the plaintext offsets must not reveal them.
+		x := *w.index
+		x.Plain = make([]int64,len(x.Plain))
+		for i := range x.Plain { x.Plain[i] = math.MaxInt64 }
+		x.Size = math.MaxInt64
+		n := encodedSize(w.codec,func(e Encoder) error { return encodeIndexBody(e,&x) })
+		body = append(body,make([]byte,int(n)-len(body))...)
+	}
+	off := w.count.n
+	idx := &Index{Chunks:w.counter,Salt:w.index.salt}
+	a,prefix,err := w.indexCipher(idx.Salt)
+	if err!=nil { return err }
+	w.nonce = chunkNonce(w.nonce,prefix,indexCounter(w.counter),true)
+	idx.Data = a.Seal(nil,w.nonce,body,w.indexAD(w.counter))
+	err = encodeIndex(w.enc,idx)
+	if err!=nil { return err }
+	var f [footerSize]byte
+	binary.BigEndian.PutUint64(f[:],uint64(off))
+	copy(f[8:],footerMagic)
+	_,err = w.count.Write(f[:])
+	return err
+}
+
+/*
+A random access reader for streams, that have been written with WriterOptions.Index set.
+Only AEAD and Stream ciphers are supported.
+
+For Stream ciphers, random access is only efficient, if the CipherObject supplies StreamAt.
+Otherwise, the records in front of the requested position are decrypted again.
+
+The signature of signed streams is not verified, as this would require reading the whole stream.
+*/
+type SeekReader struct {
+	head
+	src    io.ReaderAt
+	decr   Decrypter
+	index  indexBody
+	end    int64
+	lock   sync.Mutex
+	pos    int64
+
+	stream cipher.Stream
+	spos   int64
+
+	chunk  int
+	cached Data
+	plain  []byte
+	zbuf   []byte
+	data   []byte // The plaintext of the current chunk.
+}
+
+func NewSeekReader(r io.ReaderAt, size int64, decr Decrypter) (*SeekReader,error) {
+	g := &SeekReader{src:r,decr:decr,chunk:-1}
+	rec := newRecReader(io.NewSectionReader(r,0,size))
+	_,err := g.head.read(rec,decr,new(ReaderOptions).defaults())
+	if err!=nil { return nil,headerError(err,rec) }
+	return g.open(size)
+}
+
+// Loads the Index from the end of g.src, which is size bytes long.
+func (g *SeekReader) open(size int64) (*SeekReader,error) {
+	r := g.src
+	switch g.cipher.mode() {
+	case mBlock: return nil,ENotSeekable
+	case mStream: g.stream = g.cipher.Stream
+	case mAEAD:
+	default: return nil,EUnknownCipherType
+	}
+
+	if size<footerSize { return nil,ENoIndex }
+	f := make([]byte,footerSize)
+	_,err := r.ReadAt(f,size-footerSize)
+	if err!=nil { return nil,err }
+	if !bytes.Equal(f[8:],footerMagic) { return nil,ENoIndex }
+	g.end = int64(binary.BigEndian.Uint64(f))
+	if g.end<0 || g.end>size-footerSize { return nil,EIndexError }
+
+	idx := new(Index)
+	br := bufio.NewReader(io.NewSectionReader(r,g.end,size-footerSize-g.end))
+	err = decodeIndex(g.codec.NewDecoder(br),br,idx,int(size-footerSize-g.end))
+	if err!=nil { return nil,err }
+	if idx.Chunks>=maxChunks || len(idx.Salt)>maxSalt { return nil,EIndexError }
+	a,prefix,err := g.indexCipher(idx.Salt)
+	if err!=nil { return nil,err }
+	g.nonce = chunkNonce(g.nonce,prefix,indexCounter(idx.Chunks),true)
+	body,err := a.Open(nil,g.nonce,idx.Data,g.indexAD(idx.Chunks))
+	if err!=nil { return nil,EAuthError }
+	bb := bytes.NewReader(body)
+	err = decodeIndexBody(g.codec.NewDecoder(bb),bb,&g.index)
+	if err!=nil { return nil,err }
+	for i := range g.index.Offsets { g.index.Offsets[i] += g.origin }
+	err = g.validate()
+	if err!=nil { return nil,err }
+	if uint64(len(g.index.Offsets))!=idx.Chunks { return nil,EIndexError }
+
+	// The last record must be the terminating one.
+	last := len(g.index.Offsets)-1
+	if g.stream==nil {
+		err = g.load(last)
+	} else {
+		err = g.record(last)
+	}
+	if err!=nil { return nil,err }
+	if !g.cached.Last { return nil,ETruncated }
+	return g,nil
+}
+func (g *SeekReader) validate() error {
+	x := &g.index
+	n := len(x.Offsets)
+	if n==0 || n!=len(x.Plain) || n!=len(x.Cipher) { return EIndexError }
+	if x.Plain[0]!=0 || x.Cipher[0]!=0 || x.Offsets[0]<=0 { return EIndexError }
+	for i := 1; i<n; i++ {
+		if x.Offsets[i]<=x.Offsets[i-1] { return EIndexError }
+		if x.Plain[i]<x.Plain[i-1] { return EIndexError }
+		if x.Cipher[i]<x.Cipher[i-1] { return EIndexError }
+	}
+	if x.Offsets[n-1]>=g.end || x.Plain[n-1]>x.Size { return EIndexError }
+	// A skipped epoch starts and ends at the same record, so it is listed twice.
+	for i,e := range x.Epochs {
+		if e<0 || e>=int64(n) || (i>0 && e<x.Epochs[i-1]) || (i>1 && e==x.Epochs[i-2]) { return EIndexError }
+	}
+	if len(x.Salts)!=0 && len(x.Salts)!=len(x.Epochs) { return EIndexError }
+	for i,s := range x.Salts {
+		if len(s)>maxSalt { return EIndexError }
+		if len(s)!=0 { g.setSalt(uint64(i+1),s) }
+	}
+	return nil
+}
+// Returns the key epoch of the i-th record and its first record.
+func (g *SeekReader) epochOf(i int) (uint64,int) {
+	e := sort.Search(len(g.index.Epochs),func(j int) bool { return g.index.Epochs[j]>int64(i) })
+	if e==0 { return 0,0 }
+	return uint64(e),int(g.index.Epochs[e-1])
+}
+func (g *SeekReader) plainEnd(i int) int64 {
+	if i+1<len(g.index.Plain) { return g.index.Plain[i+1] }
+	return g.index.Size
+}
+
+/*
+Decodes the i-th record into g.cached.
+For Stream ciphers, the record is authenticated as well.
+*/
+func (g *SeekReader) record(i int) error {
+	begin := g.index.Offsets[i]
+	end := g.end
+	if i+1<len(g.index.Offsets) { end = g.index.Offsets[i+1] }
+	slack := recordSlack
+	// The signature trailer sits between the final record and the Index.
+	if i+1==len(g.index.Offsets) && g.header.Signature!="" { slack += maxSignature+recordSlack }
+	if end-begin>int64(g.maxRecord()+slack) { return EChunkTooLarge }
+	g.chunk = -1
+	err := g.codec.NewDecoder(bufio.NewReader(io.NewSectionReader(g.src,begin,end-begin))).DecodeData(&g.cached,func(l int) error {
+		if l>g.maxRecord() { return EChunkTooLarge }
+		return nil
+	})
+	if err!=nil { return err }
+	if len(g.cached.Data)>g.maxRecord() { return EChunkTooLarge }
+	if g.cached.Last!=(i+1==len(g.index.Offsets)) { return EIndexError }
+	if e,_ := g.epochOf(i); g.cached.Epoch!=e { return EIndexError }
+	if g.mac!=nil {
+		g.ad = chunkAD(g.ad,uint64(i),g.cached.Epoch,g.cached.Last,nil,g.cached.Salt)
+		if !g.mac.verify(g.cached.Tag,g.ad,g.cached.Data) { return EAuthError }
+	}
+	return nil
+}
+
+/*
+Positions the key stream at the i-th record. g.spos is the position within the
+key stream of the epoch g.epoch.
+*/
+func (g *SeekReader) seekStream(i int) error {
+	e,first := g.epochOf(i)
+	off := g.index.Cipher[i]-g.index.Cipher[first]
+	if g.epoch==e && g.spos==off { return nil }
+	// The key stream of epoch 0 starts with the encrypted MAC key and the Metadata.
+	koff := int64(0)
+	if e==0 { koff = int64(len(g.header.Key)+len(g.metaRaw)) }
+	if g.cipher.StreamAt!=nil {
+		err := g.seekEpoch(e)
+		if err!=nil { return err }
+		s,err := g.cipher.StreamAt(koff+off)
+		if err!=nil { return err }
+		g.stream,g.spos = s,off
+		return nil
+	}
+	if g.epoch!=e || off<g.spos {
+		var c *CipherObject
+		var err error
+		if e==0 {
+			c,err = g.decr.StartDecryption(g.pre)
+			if err!=nil { return err }
+			if c.mode()!=mStream { return EUnknownCipherType }
+			g.plain = stretch(g.plain,len(g.header.Key))
+			c.Stream.XORKeyStream(g.plain,g.header.Key)
+			g.plain = stretch(g.plain,len(g.metaRaw))
+			c.Stream.XORKeyStream(g.plain,g.metaRaw)
+		} else {
+			// The cipher of an epoch is derived from the previous one, with a fresh key stream.
+			err = g.seekEpoch(e-1)
+			if err!=nil { return err }
+			c,err = g.cipher.Next(g.salts[e])
+			if err!=nil { return err }
+		}
+		g.cipher,g.epoch = c,e
+		g.stream,g.spos = c.Stream,0
+		g.chunk = -1
+	}
+	/*
+	Decrypt the records in between. Some key streams (CFB) depend on the ciphertext,
+	so we can't just discard the key stream.
+	*/
+	ci := g.index.Cipher[first:i]
+	i = first+sort.Search(len(ci),func(j int) bool { return ci[j]-ci[0]>=g.spos })
+	for ; g.spos<off ; i++ {
+		err := g.record(i)
+		if err!=nil { return err }
+		g.plain = stretch(g.plain,len(g.cached.Data))
+		g.stream.XORKeyStream(g.plain,g.cached.Data)
+		g.spos += int64(len(g.plain))
+	}
+	if g.spos!=off { return EIndexError }
+	return nil
+}
+
+// Decrypts the i-th record into g.plain.
+func (g *SeekReader) load(i int) (err error) {
+	if g.chunk==i { return nil }
+	if g.stream!=nil {
+		err = g.seekStream(i)
+		if err!=nil { return }
+	} else {
+		e,_ := g.epochOf(i)
+		err = g.seekEpoch(e)
+		if err!=nil { return }
+	}
+	err = g.record(i)
+	if err!=nil { return }
+	if g.stream!=nil {
+		g.plain = stretch(g.plain,len(g.cached.Data))
+		g.stream.XORKeyStream(g.plain,g.cached.Data)
+		g.spos += int64(len(g.plain))
+	} else {
+		g.nonce = chunkNonce(g.nonce,g.header.Nonce,uint64(i),g.cached.Last)
+		g.ad = chunkAD(g.ad,uint64(i),g.epoch,g.cached.Last,g.binding,g.cached.Salt)
+		g.plain,err = g.cipher.AEAD.Open(g.plain[:0],g.nonce,g.cached.Data,g.ad)
+		if err!=nil { return }
+	}
+	g.data,err = g.inflate(&g.zbuf,g.plain)
+	if err!=nil { return }
+	if int64(len(g.data))!=g.plainEnd(i)-g.index.Plain[i] { return EIndexError }
+	g.chunk = i
+	return
+}
+
+// Returns the total plaintext size.
+func (g *SeekReader) Size() int64 { return g.index.Size }
+
+/*
+ReadAt, Read and Seek are safe for concurrent use. Concurrent Reads share the position
+of the SeekReader, so their order is undefined.
+*/
+func (g *SeekReader) ReadAt(p []byte, off int64) (n int, err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.readAt(p,off)
+}
+func (g *SeekReader) readAt(p []byte, off int64) (n int, err error) {
+	if off<0 { return 0,ESeekError }
+	for len(p)>0 {
+		if off>=g.index.Size { return n,io.EOF }
+		i := sort.Search(len(g.index.Plain),func(j int) bool { return g.plainEnd(j)>off })
+		err = g.load(i)
+		if err!=nil { return }
+		m := copy(p,g.data[off-g.index.Plain[i]:])
+		n += m
+		off += int64(m)
+		p = p[m:]
+	}
+	return
+}
+func (g *SeekReader) Read(p []byte) (n int, err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	n,err = g.readAt(p,g.pos)
+	g.pos += int64(n)
+	return
+}
+func (g *SeekReader) Seek(offset int64, whence int) (int64, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent: offset += g.pos
+	case io.SeekEnd: offset += g.index.Size
+	default: return g.pos,fmt.Errorf("Invalid whence %d",whence)
+	}
+	if offset<0 { return g.pos,ESeekError }
+	g.pos = offset
+	return offset,nil
+}
@@ -0,0 +1,64 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "bytes"
+import "io"
+import "sync"
+import "testing"
+
+func TestSeekReader(t *testing.T) {
+	for _,mode := range []int{mAEAD,mStream} {
+		ts := &testSuite{Mode:mode}
+		data := testData(10000)
+		ct := encryptAll(t,ts,&WriterOptions{Index:true,ChunkSize:512},data)
+		g,err := NewSeekReader(bytes.NewReader(ct),int64(len(ct)),ts)
+		if err!=nil { t.Fatal(err) }
+		if g.Size()!=int64(len(data)) { t.Fatalf("Size: got %d, want %d",g.Size(),len(data)) }
+		
+		// ReadAt, Read and Seek from several goroutines (run with -race).
+		var wg sync.WaitGroup
+		for i := 0; i<4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				b := make([]byte,700)
+				for off := int64(i*300); off<int64(len(data)); off += 1100 {
+					n,err := g.ReadAt(b,off)
+					if err!=nil && err!=io.EOF { t.Error(err); return }
+					if !bytes.Equal(b[:n],data[off:off+int64(n)]) { t.Errorf("ReadAt %d: plaintext mismatch",off); return }
+					g.Seek(off,io.SeekStart)
+					g.Read(b)
+				}
+			}(i)
+		}
+		wg.Wait()
+		
+		// Tampering with the sealed Index.
+		bad := append([]byte(nil),ct...)
+		bad[len(bad)-footerSize-3] ^= 1
+		_,err = NewSeekReader(bytes.NewReader(bad),int64(len(bad)),ts)
+		if err==nil { t.Fatal("tampered Index accepted") }
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package format2
+
+import "io"
+import "io/ioutil"
+
+/*
+Information about a stream, that can be obtained without any key.
+*/
+type StreamInfo struct {
+	Version  int
+	Codec    string    // The wire codec, see WriterOptions.Codec.
+	Preamble *Preamble // The cipher, PK_Algo, Encoding and Recipients.
+	Header   *Header   // nil for version 0 streams.
+	Binding  []byte    // nil for version 0 streams. It pairs detached heads and bodies, see ReadBodyBinding.
+}
+
+/*
+Parses the magic, the Preamble and the Header of a stream, without decrypting anything.
+
+Nothing returned by this function is authenticated. It tells, which algorithm and which
+keys a stream is encrypted for, but a stream, that can be inspected, needs not decrypt.
+*/
+func ReadPreamble(r io.Reader) (*StreamInfo,error) {
+	rec := newRecReader(r)
+	h := new(head)
+	_,err := h.parse(rec,new(ReaderOptions).defaults())
+	if err!=nil { return nil,err }
+	info := &StreamInfo{Version:h.version,Codec:h.codecName,Preamble:h.pre,Binding:h.binding}
+	if h.version!=0 { info.Header = &h.header }
+	return info,nil
+}
+
+// The result of Verify.
+type VerifyReport struct {
+	Chunks uint64 // The number of chunks, that were authenticated.
+	Size   int64  // The size of the plaintext, that was authenticated.
+	
+	// The index of the first failing chunk or -1, if the stream
+	// was verified successfully or the Preamble/Header was rejected.
+	Failed int64
+}
+
+/*
+Decrypts and authenticates the entire stream, discarding the plaintext.
+
+The report is returned even if the verification fails.
+*/
+func Verify(r io.Reader,decr Decrypter,opt *ReaderOptions) (*VerifyReport,error) {
+	rep := &VerifyReport{Failed:-1}
+	rd,err := NewReader2(r,decr,opt)
+	if err!=nil { return rep,err }
+	g := rd.(*Reader)
+	rep.Size,err = io.Copy(ioutil.Discard,g)
+	rep.Chunks = g.counter
+	if err!=nil { rep.Failed = int64(g.counter) }
+	return rep,err
+}
@@ -0,0 +1,89 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "bytes"
+import "errors"
+import "fmt"
+import "io"
+import "testing"
+
+var errNoKey = fmt.Errorf("No key")
+
+type failDecrypter struct{}
+func (failDecrypter) StartDecryption(p *Preamble) (*CipherObject,error) { return nil,errNoKey }
+
+func TestReadPreamble(t *testing.T) {
+	const cs = 1024
+	data := testData(3000)
+	for _,mode := range []int{mAEAD,mBlock,mStream} {
+		ts := &testSuite{Mode:mode}
+		ct := encryptAll(t,ts,&WriterOptions{ChunkSize:cs,Compression:"flate",Metadata:&Metadata{Name:"x"}},data)
+		info,err := ReadPreamble(bytes.NewReader(ct))
+		if err!=nil { t.Fatal(err) }
+		r,err := newReader(bytes.NewReader(ct),ts,nil)
+		if err!=nil { t.Fatal(err) }
+		if info.Version!=Version || info.Codec!=DefaultCodec { t.Errorf("mode %d: version %d, codec %q",mode,info.Version,info.Codec) }
+		if info.Preamble.PK_Algo!="test" || info.Preamble.Encoding!="test" { t.Errorf("mode %d: Preamble %+v",mode,info.Preamble) }
+		h := info.Header
+		if h==nil || h.MaxChunk!=cs || h.Compression!="flate" || !h.Metadata || !bytes.Equal(h.Nonce,r.header.Nonce) || !bytes.Equal(h.Key,r.header.Key) {
+			t.Errorf("mode %d: Header %+v",mode,h)
+		}
+		if !bytes.Equal(info.Binding,r.binding) { t.Errorf("mode %d: Binding %x, want %x",mode,info.Binding,r.binding) }
+	}
+	
+	info,err := ReadPreamble(bytes.NewReader(legacyStream(t,&testSuite{Mode:mAEAD},data,1000)))
+	if err!=nil { t.Fatal(err) }
+	if info.Version!=0 || info.Header!=nil || info.Binding!=nil || info.Preamble.PK_Algo!="test" { t.Errorf("version 0: %+v",info) }
+	
+	_,err = ReadPreamble(bytes.NewReader([]byte{0xc1,'F','3',1}))
+	if err!=EBadMagic { t.Errorf("got %v, want EBadMagic",err) }
+}
+
+func TestVerify(t *testing.T) {
+	const cs = 1024
+	data := testData(4*cs+cs/2)
+	ts := &testSuite{Mode:mAEAD}
+	ct := encryptAll(t,ts,&WriterOptions{ChunkSize:cs},data)
+	o := chunkOffsets(t,ts,ct)
+	tampered := append([]byte(nil),ct...)
+	tampered[(o[2]+o[3])/2] ^= 1
+	for _,tc := range []struct{
+		name string
+		ct   []byte
+		decr Decrypter
+		want VerifyReport
+		err  error
+	}{
+		{"intact",ct,ts,VerifyReport{Chunks:5,Size:int64(len(data)),Failed:-1},nil},
+		{"tampered",tampered,ts,VerifyReport{Chunks:2,Size:2*cs,Failed:2},EAuthError},
+		{"truncated",ct[:o[4]],ts,VerifyReport{Chunks:4,Size:4*cs,Failed:4},ETruncated},
+		{"header",ct[:o[0]-1],ts,VerifyReport{Failed:-1},io.ErrUnexpectedEOF},
+		{"key",ct,failDecrypter{},VerifyReport{Failed:-1},errNoKey},
+	} {
+		rep,err := Verify(bytes.NewReader(tc.ct),tc.decr,nil)
+		if rep==nil || *rep!=tc.want { t.Errorf("%s: got %+v, want %+v",tc.name,rep,tc.want) }
+		if (tc.err==nil && err!=nil) || !errors.Is(err,tc.err) { t.Errorf("%s: got %v, want %v",tc.name,err,tc.err) }
+	}
+}
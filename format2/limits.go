@@ -0,0 +1,160 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "io"
+import "math"
+
+/*
+A limit of ReaderOptions has been exceeded. The value names the limit.
+*/
+type LimitError string
+func (e LimitError) Error() string { return "Limit exceeded: "+string(e) }
+
+const (
+	DefaultMaxPreamble = 64<<10
+	DefaultMaxChunk = 16<<20
+)
+
+// Room for the framing, the Nonce and the Tag of a Data record.
+const recordSlack = 256
+
+/*
+Limits for decoding untrusted input. They are enforced, before the memory is allocated.
+*/
+type ReaderOptions struct {
+	// Maximum size of the serialized Preamble, Header and header tag. Defaults to DefaultMaxPreamble.
+	MaxPreamble int
+	
+	// Maximum size of Preamble.Opaque. Defaults to MaxPreamble.
+	MaxOpaque int
+	
+	// Maximum size of an encrypted chunk. Defaults to DefaultMaxChunk.
+	// Chunks are also limited by the MaxChunk value of the Header.
+	MaxChunk int
+	
+	// Maximum amount of plaintext. Zero means unlimited.
+	MaxOutput int64
+	
+	// Accept version 0 streams, written before the magic was introduced.
+	// Such streams are not protected against truncation, and for Block and Stream ciphers
+	// they are not authenticated at all. As an attacker could strip the authentication
+	// from newer streams this way, this should only be set for trusted input.
+	Legacy bool
+	
+	// Critical Metadata keys, that the application understands. Streams with other
+	// critical keys are rejected with a CriticalMetadataError.
+	Critical []string
+	
+	// Reject unsigned streams with ENotSigned.
+	RequireSignature bool
+}
+func (o *ReaderOptions) defaults() *ReaderOptions {
+	n := new(ReaderOptions)
+	if o!=nil { *n = *o }
+	if n.MaxPreamble<=0 { n.MaxPreamble = DefaultMaxPreamble }
+	if n.MaxOpaque<=0 || n.MaxOpaque>n.MaxPreamble { n.MaxOpaque = n.MaxPreamble }
+	if n.MaxChunk<=0 { n.MaxChunk = DefaultMaxChunk }
+	return n
+}
+
+// Lifts the limit of a recReader.
+func (r *recReader) unlimit() { r.left = math.MaxInt64 }
+
+// Limits the number of bytes, that can be read, until the next call to limit.
+func (r *recReader) limit(n int,what string) { r.left,r.what = int64(n),what }
+
+/*
+Decodes a byte string, that must not exceed max bytes, into b.
+*/
+func decodeBytes(dec Decoder,r io.Reader,b []byte,max int,what string) ([]byte,error) {
+	n,err := dec.DecodeBytesLen()
+	if err!=nil { return nil,err }
+	if n<0 { return b[:0],nil }
+	if n>max { return nil,LimitError(what) }
+	b = stretch(b,n)
+	_,err = io.ReadFull(r,b)
+	return b,err
+}
+
+/*
+Decodes a string, that must not exceed max bytes.
+*/
+func decodeString(dec Decoder,r io.Reader,max int,what string) (string,error) {
+	b,err := decodeBytes(dec,r,nil,max,what)
+	return string(b),err
+}
+
+func decodePreamble(dec Decoder,r io.Reader,p *Preamble,opt *ReaderOptions) (err error) {
+	n,err := dec.DecodeArrayLen()
+	if err!=nil { return }
+	if n<0 { return EHeaderError }
+	for i := 0; i<n && err==nil; i++ {
+		switch i {
+		case 0: p.Opaque,err = decodeBytes(dec,r,nil,opt.MaxOpaque,"Opaque")
+		case 1: p.PK_Algo,err = decodeString(dec,r,opt.MaxPreamble,"Preamble")
+		case 2: p.Encoding,err = decodeString(dec,r,opt.MaxPreamble,"Preamble")
+		case 3:
+			var m int
+			m,err = dec.DecodeArrayLen()
+			// Every stanza consumes input, so the number of stanzas is bounded by MaxPreamble.
+			for j := 0; j<m && err==nil; j++ {
+				var rc Recipient
+				err = decodeRecipient(dec,r,&rc,opt)
+				p.Recipients = append(p.Recipients,rc)
+			}
+		case 4: p.Wrapped,err = dec.DecodeBool()
+		default: err = dec.Skip()
+		}
+	}
+	return
+}
+func decodeRecipient(dec Decoder,r io.Reader,rc *Recipient,opt *ReaderOptions) (err error) {
+	n,err := dec.DecodeArrayLen()
+	if err!=nil { return }
+	if n<0 { return EHeaderError }
+	for i := 0; i<n && err==nil; i++ {
+		switch i {
+		case 0: rc.PK_Algo,err = decodeString(dec,r,opt.MaxPreamble,"Preamble")
+		case 1: rc.Opaque,err = decodeBytes(dec,r,nil,opt.MaxOpaque,"Opaque")
+		case 2: rc.Key,err = decodeBytes(dec,r,nil,opt.MaxOpaque,"Opaque")
+		default: err = dec.Skip()
+		}
+	}
+	return
+}
+
+/*
+Decodes the next Data record into r.cached.
+*/
+func (r *Reader) decodeData() error {
+	max := r.maxRecord()
+	if max>r.opt.MaxChunk { max = r.opt.MaxChunk }
+	r.rec.limit(max+recordSlack,"Chunk")
+	return r.dec.DecodeData(&r.cached,func(l int) error {
+		if l>r.maxRecord() { return EChunkTooLarge }
+		if l>max { return LimitError("Chunk") }
+		return nil
+	})
+}
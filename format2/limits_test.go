@@ -0,0 +1,91 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "bytes"
+import "errors"
+import "runtime"
+import "testing"
+
+// Returns the number of bytes allocated by f.
+func allocated(f func()) uint64 {
+	var a,b runtime.MemStats
+	runtime.ReadMemStats(&a)
+	f()
+	runtime.ReadMemStats(&b)
+	return b.TotalAlloc-a.TotalAlloc
+}
+
+// A msgpack bin 32 or str 32 header, that announces 1 GiB.
+var (
+	hugeBin = []byte{0xc6,0x40,0,0,0}
+	hugeStr = []byte{0xdb,0x40,0,0,0}
+)
+
+/*
+Streams, that announce huge fields, must fail with the LimitError, before the memory is allocated.
+*/
+func TestLimits(t *testing.T) {
+	const cs = 1024
+	data := testData(3*cs)
+	ts := &testSuite{Mode:mAEAD}
+	ct := encryptAll(t,ts,&WriterOptions{ChunkSize:cs,MaxChunkSize:1<<30},data)
+	o := chunkOffsets(t,ts,ct)
+	cat := func(parts ...[]byte) []byte {
+		var b []byte
+		for _,p := range parts { b = append(b,p...) }
+		return b
+	}
+	prefix := cat(magic,[]byte{Version})
+	for _,tc := range []struct{
+		name  string
+		ct    []byte
+		opt   *ReaderOptions
+		limit string
+	}{
+		// Preamble: [Opaque, PK_Algo, Encoding, Recipients]
+		{"Opaque",cat(prefix,[]byte{0x94},hugeBin),nil,"Opaque"},
+		{"small Opaque",ct,&ReaderOptions{MaxOpaque:1},""},
+		{"PK_Algo",cat(prefix,[]byte{0x94,0xc4,0},hugeStr),nil,"Preamble"},
+		{"small Preamble",ct,&ReaderOptions{MaxPreamble:16},"Preamble"},
+		// Data: [Last, Nonce, Data, Tag]
+		{"Data",cat(ct[:o[0]],[]byte{0x94,0xc2,0xc4,0},hugeBin),nil,"Chunk"},
+		{"small Chunk",ct,&ReaderOptions{MaxChunk:cs/2},"Chunk"},
+		{"Output",ct,&ReaderOptions{MaxOutput:2*cs+1},"Output"},
+	} {
+		var pt []byte
+		var err error
+		n := allocated(func() { pt,err = readAll(ts,tc.ct,tc.opt) })
+		if n>1<<20 { t.Errorf("%s: %d bytes allocated",tc.name,n) }
+		if tc.limit=="" {
+			if err!=nil || !bytes.Equal(pt,data) { t.Errorf("%s: %v",tc.name,err) }
+			continue
+		}
+		var le LimitError
+		if !errors.As(err,&le) || string(le)!=tc.limit {
+			t.Errorf("%s: got %v, want LimitError(%q)",tc.name,err,tc.limit)
+		}
+		if tc.limit=="Output" && !bytes.Equal(pt,data[:2*cs]) { t.Errorf("%s: got %d bytes of plaintext",tc.name,len(pt)) }
+	}
+}
@@ -0,0 +1,184 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "bytes"
+import "io"
+import "time"
+
+/*
+The Metadata contains a critical key, that is not understood by the Reader.
+See ReaderOptions.Critical.
+*/
+type CriticalMetadataError string
+func (e CriticalMetadataError) Error() string { return "Unsupported critical Metadata: "+string(e) }
+
+/*
+An application-defined metadata entry.
+
+If Critical is set, Readers, that don't understand the Key, reject the stream.
+Otherwise, unknown entries are passed through.
+*/
+type MetaValue struct {
+	_msgpack struct{} `msgpack:",asArray"`
+	Key      string
+	Critical bool
+	Value    []byte
+}
+
+/*
+Metadata of the encrypted file. It is encrypted and authenticated, and follows the header tag.
+*/
+type Metadata struct {
+	Name        string
+	ContentType string
+	ModTime     time.Time
+	Values      []MetaValue
+}
+
+// Built-in keys. They are never critical.
+const (
+	metaName = "name"
+	metaContentType = "content-type"
+	metaModTime = "mtime"
+)
+
+var metaAD = []byte("format2-metadata")
+
+// The AEAD nonce of the metadata is taken from the reserved counter range, see chunkNonce.
+const metaCounter = maxChunks|1
+
+type metaRecord struct {
+	_msgpack struct{} `msgpack:",asArray"`
+	Data []byte
+	Tag  []byte // Block and Stream ciphers only.
+}
+
+func (m *Metadata) entries() []MetaValue {
+	var e []MetaValue
+	if m.Name!="" { e = append(e,MetaValue{Key:metaName,Value:[]byte(m.Name)}) }
+	if m.ContentType!="" { e = append(e,MetaValue{Key:metaContentType,Value:[]byte(m.ContentType)}) }
+	if !m.ModTime.IsZero() {
+		t,_ := m.ModTime.MarshalText()
+		e = append(e,MetaValue{Key:metaModTime,Value:t})
+	}
+	return append(e,m.Values...)
+}
+func (m *Metadata) parse(e []MetaValue,critical []string) error {
+	for _,v := range e {
+		switch v.Key {
+		case metaName: m.Name = string(v.Value)
+		case metaContentType: m.ContentType = string(v.Value)
+		case metaModTime:
+			err := m.ModTime.UnmarshalText(v.Value)
+			if err!=nil { return err }
+		default:
+			if v.Critical && !contains(critical,v.Key) { return CriticalMetadataError(v.Key) }
+			m.Values = append(m.Values,v)
+		}
+	}
+	return nil
+}
+func contains(l []string,s string) bool {
+	for _,e := range l { if e==s { return true } }
+	return false
+}
+
+func (h *head) metaAD() []byte {
+	h.ad = append(h.ad[:0],metaAD...)
+	if h.cipher.mode()==mAEAD { h.ad = append(h.ad,h.binding...) }
+	return h.ad
+}
+
+// Written right after the header tag, if WriterOptions.Metadata is set.
+func (w *Writer) writeMetadata(m *Metadata) error {
+	body,err := marshal(w.codec,func(e Encoder) error { return encodeEntries(e,m.entries()) })
+	if err!=nil { return err }
+	rec := new(metaRecord)
+	switch w.cipher.mode() {
+	case mAEAD:
+		w.nonce = chunkNonce(w.nonce,w.header.Nonce,metaCounter,false)
+		rec.Data = w.cipher.AEAD.Seal(nil,w.nonce,body,w.metaAD())
+	case mStream:
+		rec.Data = make([]byte,len(body))
+		w.cipher.Stream.XORKeyStream(rec.Data,body)
+	case mBlock:
+		bz := w.cipher.Block.BlockSize()
+		rec.Data = make([]byte,(len(body)/bz+1)*bz)
+		copy(rec.Data,body)
+		w.padd(rec.Data[len(body):])
+		w.cipher.Block.CryptBlocks(rec.Data,rec.Data)
+	}
+	if w.mac!=nil { rec.Tag = w.mac.tag(nil,w.metaAD(),rec.Data) }
+	w.metaRaw = rec.Data
+	w.meta = m
+	return encodeRecord(w.enc,rec.Data,rec.Tag)
+}
+
+func (h *head) readMetadata(dec Decoder,r io.Reader,opt *ReaderOptions) (err error) {
+	n,err := dec.DecodeArrayLen()
+	if err!=nil { return }
+	if n<2 { return EMalformedRecord }
+	rec := new(metaRecord)
+	rec.Data,err = decodeBytes(dec,r,nil,opt.MaxPreamble,"Metadata")
+	if err!=nil { return }
+	rec.Tag,err = decodeBytes(dec,r,nil,recordSlack,"Metadata")
+	if err!=nil { return }
+	for i := 2; i<n; i++ {
+		err = dec.Skip()
+		if err!=nil { return }
+	}
+	var body []byte
+	switch h.cipher.mode() {
+	case mAEAD:
+		h.nonce = chunkNonce(h.nonce,h.header.Nonce,metaCounter,false)
+		body,err = h.cipher.AEAD.Open(nil,h.nonce,rec.Data,h.metaAD())
+		if err!=nil { return EAuthError }
+	case mStream:
+		if !h.mac.verify(rec.Tag,h.metaAD(),rec.Data) { return EAuthError }
+		body = make([]byte,len(rec.Data))
+		h.cipher.Stream.XORKeyStream(body,rec.Data)
+	case mBlock:
+		if !h.mac.verify(rec.Tag,h.metaAD(),rec.Data) { return EAuthError }
+		bz := h.cipher.Block.BlockSize()
+		if len(rec.Data)==0 || len(rec.Data)%bz!=0 { return EBlockAlignmentError }
+		body = make([]byte,len(rec.Data))
+		h.cipher.Block.CryptBlocks(body,rec.Data)
+		sz := len(body)-bz
+		n,err := h.unpadd(body[sz:])
+		if err!=nil { return err }
+		body = body[:sz+n]
+	}
+	br := bytes.NewReader(body)
+	e,err := decodeEntries(h.codec.NewDecoder(br),br,len(body))
+	if err!=nil { return }
+	h.meta = new(Metadata)
+	h.metaRaw = rec.Data
+	return h.meta.parse(e,opt.Critical)
+}
+
+/*
+Returns the Metadata of the stream, or nil, if it has none.
+*/
+func (h *head) Metadata() *Metadata { return h.meta }
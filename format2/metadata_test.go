@@ -0,0 +1,76 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "bytes"
+import "errors"
+import "io/ioutil"
+import "reflect"
+import "testing"
+import "time"
+
+func TestMetadata(t *testing.T) {
+	data := testData(3000)
+	meta := &Metadata{
+		Name:"report.txt",
+		ContentType:"text/plain",
+		ModTime:time.Date(2019,5,1,12,0,0,0,time.UTC),
+		Values:[]MetaValue{
+			{Key:"x-app",Critical:true,Value:[]byte("must be understood")},
+			{Key:"note",Value:[]byte("may be ignored")},
+		},
+	}
+	for _,mode := range []int{mAEAD,mBlock,mStream} {
+		ts := &testSuite{Mode:mode}
+		ct := encryptAll(t,ts,&WriterOptions{Metadata:meta},data)
+		
+		r,err := NewReader2(bytes.NewReader(ct),ts,&ReaderOptions{Critical:[]string{"x-app"}})
+		if err!=nil { t.Fatalf("mode %d: %v",mode,err) }
+		got := r.(*Reader).Metadata()
+		if got==nil || got.Name!=meta.Name || got.ContentType!=meta.ContentType || !got.ModTime.Equal(meta.ModTime) || !reflect.DeepEqual(got.Values,meta.Values) {
+			t.Errorf("mode %d: got %+v",mode,got)
+		}
+		pt,err := ioutil.ReadAll(r)
+		if err!=nil || !bytes.Equal(pt,data) { t.Errorf("mode %d: %v",mode,err) }
+		
+		// The critical key is not understood.
+		for _,critical := range [][]string{nil,{"note"}} {
+			_,err = readAll(ts,ct,&ReaderOptions{Critical:critical})
+			var ce CriticalMetadataError
+			if !errors.As(err,&ce) || ce!="x-app" { t.Errorf("mode %d, Critical %v: got %v, want CriticalMetadataError",mode,critical,err) }
+		}
+	}
+	
+	// Unknown keys, that are not critical, are passed through.
+	ts := &testSuite{Mode:mAEAD}
+	ct := encryptAll(t,ts,&WriterOptions{Metadata:&Metadata{Values:meta.Values[1:]}},data)
+	r,err := NewReader2(bytes.NewReader(ct),ts,nil)
+	if err!=nil { t.Fatal(err) }
+	if got := r.(*Reader).Metadata(); got==nil || !reflect.DeepEqual(got.Values,meta.Values[1:]) { t.Errorf("got %+v",got) }
+	
+	// Streams without Metadata.
+	r,err = NewReader2(bytes.NewReader(encryptAll(t,ts,nil,data)),ts,nil)
+	if err!=nil { t.Fatal(err) }
+	if got := r.(*Reader).Metadata(); got!=nil { t.Errorf("got %+v, want nil",got) }
+}
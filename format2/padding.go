@@ -0,0 +1,167 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package format2
+
+import "encoding/binary"
+import "math/bits"
+import "fmt"
+
+var EPadding = fmt.Errorf("Invalid padded Size")
+
+/*
+A padding policy, see WriterOptions.Padding. It maps the length of the stream to the
+padded length, which must not be smaller. Where the records can't reach the padded
+length exactly (Block ciphers, or the length prefix of a record grows), the Writer
+exceeds it by a few bytes.
+*/
+type Padding func(size int64) int64
+
+// Pads the stream to a multiple of n bytes.
+func PadMultiple(n int64) Padding {
+	return func(size int64) int64 {
+		if n<=1 { return size }
+		return ((size+n-1)/n)*n
+	}
+}
+
+// Pads the stream to the next power of two. The overhead is up to 100%.
+func PadPowerOfTwo(size int64) int64 {
+	p := int64(1)
+	for p<size { p <<= 1 }
+	return p
+}
+
+/*
+PADMÉ, as proposed in "Reducing Metadata Leakage from Encrypted Files and Communication
+with PURBs" (Nikitin et al. 2019). It leaks O(log log size) bits of the size, with an
+overhead of at most 12%.
+*/
+func PadPadme(size int64) int64 {
+	if size<2 { return size }
+	e := bits.Len64(uint64(size))-1
+	s := bits.Len64(uint64(e))
+	mask := int64(1)<<uint(e-s)-1
+	return (size+mask)&^mask
+}
+
+/*
+Chunk padding, if Header.Padding is set. The plaintext of every chunk (after compression)
+is followed by zero bytes and its own length:
+
+	[n bytes] plaintext
+	[m bytes] zero bytes
+	[4 bytes] n (big endian)
+
+All chunks except the final one are filled to the same size, the chunk size plus the
+trailer (and the flag byte of the compression). On Close, the Writer adds empty chunks
+and chooses the size of the final chunk, so that the stream reaches the size chosen by
+the policy. Thus, the records only depend on the padded size, and the padding is
+encrypted and authenticated along with the data.
+*/
+const padTrailer = 4
+
+// The size of the padded plaintext of the next chunk.
+func (w *Writer) fillSize() int {
+	if w.fill>0 { return w.fill }
+	n := w.chunk+padTrailer
+	if w.comp!=nil { n++ }
+	return n
+}
+
+// Pads the plaintext p of a chunk to w.fillSize() bytes.
+func (w *Writer) padChunk(p []byte) ([]byte,error) {
+	n := w.fillSize()
+	if len(p)+padTrailer>n { return nil,EPadding }
+	w.pbuf = stretch(w.pbuf,n)
+	copy(w.pbuf,p)
+	for i := len(p); i<n; i++ { w.pbuf[i] = 0 }
+	binary.BigEndian.PutUint32(w.pbuf[n-padTrailer:],uint32(len(p)))
+	return w.pbuf,nil
+}
+
+// Strips the padding from the plaintext of a chunk.
+func (h *head) unpadChunk(p []byte) ([]byte,error) {
+	if len(p)<padTrailer { return nil,EMalformedRecord }
+	t := len(p)-padTrailer
+	n := binary.BigEndian.Uint32(p[t:])
+	if uint64(n)>uint64(t) { return nil,EMalformedRecord }
+	var acc byte
+	for _,b := range p[n:t] { acc |= b }
+	if acc!=0 { return nil,EMalformedRecord }
+	return p[:n],nil
+}
+
+// Size of the encoded Data record of the next chunk, with p bytes of padded plaintext.
+func (w *Writer) recordSize(p int,last bool) int64 {
+	n := p
+	switch w.cipher.mode() {
+	case mBlock:
+		bz := w.cipher.Block.BlockSize()
+		n = (p/bz+1)*bz
+	case mAEAD:
+		n += w.cipher.AEAD.Overhead()
+	}
+	d := &Data{Last:last,Epoch:w.epoch}
+	w.zero = stretch(w.zero,n+macSize)
+	d.Data = w.zero[:n]
+	if w.cipher.mode()!=mAEAD { d.Tag = w.zero[n:] }
+	return encodedSize(w.codec,func(e Encoder) error { return e.EncodeData(d) })
+}
+
+/*
+Emits the buffered data, the empty chunks and the final chunk of a padded stream.
+
+The buffered data goes into the final chunk, if it is the only one left, otherwise into
+a full one. The empty chunks and the size of the final chunk only depend on the
+size chosen by the policy. Sizes between a full final chunk and a full chunk followed by
+the smallest final chunk can't be reached, they are rounded up.
+*/
+func (w *Writer) closePadded() error {
+	full := w.fillSize()
+	n := w.buffer.Len()
+	data := n+padTrailer
+	if w.comp!=nil { data++ }
+	size := w.padding(w.count.n+w.recordSize(data,true))
+	if size<w.count.n+w.recordSize(data,true) { return EPadding }
+	for {
+		// Switch the epoch first, it determines the size of the record.
+		err := w.rotate(full)
+		if err!=nil { return err }
+		if size-w.count.n<=w.recordSize(full,true) { break }
+		err = w.coder(w,n,false)
+		if err!=nil { return err }
+		n = 0
+	}
+	if n==0 { data = padTrailer; if w.comp!=nil { data++ } }
+	
+	// The smallest final chunk, that reaches the size.
+	left := size-w.count.n
+	lo,hi := data,full
+	for lo<hi {
+		m := (lo+hi)/2
+		if w.recordSize(m,true)>=left { hi = m } else { lo = m+1 }
+	}
+	w.fill = lo
+	defer func() { w.fill = 0 }()
+	return w.coder(w,n,true)
+}
@@ -0,0 +1,84 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "bytes"
+import "fmt"
+import "testing"
+
+type constReader byte
+func (c constReader) Read(p []byte) (int,error) {
+	for i := range p { p[i] = byte(c) }
+	return len(p),nil
+}
+
+/*
+Returns the clear parts of a stream: the head (up to the Metadata), the framing of
+every Data record, and the size of what follows the final one (the Index).
+*/
+func framing(t *testing.T,decr Decrypter,ct []byte) (head []byte,recs []string,tail int) {
+	t.Helper()
+	r,err := newReader(bytes.NewReader(ct),decr,nil)
+	if err!=nil { t.Fatal(err) }
+	head = ct[:r.rec.pos]
+	for {
+		off := r.rec.pos
+		err = r.decodeData()
+		if err!=nil { t.Fatal(err) }
+		recs = append(recs,fmt.Sprintf("@%d last=%v epoch=%d data=%d tag=%d",off,r.cached.Last,r.cached.Epoch,len(r.cached.Data),len(r.cached.Tag)))
+		if r.cached.Last { break }
+	}
+	return head,recs,len(ct)-int(r.rec.pos)
+}
+
+// Inputs of different length, that are padded to the same size, must not differ in their clear bytes.
+func TestPaddingHidesSize(t *testing.T) {
+	for _,mode := range []int{mAEAD,mStream} {
+		for _,comp := range []string{"","flate"} {
+			for _,index := range []bool{false,true} {
+				ts := &testSuite{Mode:mode,Next:true}
+				opt := &WriterOptions{ChunkSize:4096,Padding:PadMultiple(1<<16),Index:index,Compression:comp,Random:constReader(7),RekeyChunks:5}
+				var heads [][]byte
+				var recs [][]string
+				var tails []int
+				var sizes []int
+				for _,n := range []int{0,1000,4096,20000,50001} {
+					data := testData(n)
+					ct := encryptAll(t,ts,opt,data)
+					if pt := decryptAll(t,ts,ct); !bytes.Equal(pt,data) { t.Fatal("plaintext mismatch") }
+					h,r,tl := framing(t,ts,ct)
+					heads,recs,tails,sizes = append(heads,h),append(recs,r),append(tails,tl),append(sizes,len(ct))
+				}
+				for i := 1; i<len(sizes); i++ {
+					what := fmt.Sprintf("mode %d, compression %q, index %v, input %d",mode,comp,index,i)
+					if sizes[i]!=sizes[0] { t.Fatalf("%s: size %d, want %d",what,sizes[i],sizes[0]) }
+					if !bytes.Equal(heads[i],heads[0]) { t.Fatalf("%s: head differs",what) }
+					if fmt.Sprint(recs[i])!=fmt.Sprint(recs[0]) { t.Fatalf("%s: records differ\n%v\n%v",what,recs[i],recs[0]) }
+					if tails[i]!=tails[0] { t.Fatalf("%s: Index size %d, want %d",what,tails[i],tails[0]) }
+				}
+				if sizes[0]-tails[0]!=1<<16 { t.Fatalf("padded size %d, want %d",sizes[0]-tails[0],1<<16) }
+			}
+		}
+	}
+}
@@ -0,0 +1,296 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "fmt"
+import "bytes"
+import "io"
+import "io/ioutil"
+import "bufio"
+
+var ENotRecoverable = fmt.Errorf("Stream can not be recovered")
+
+// The number of chunk counters tried on a resynchronized record.
+const recoverTries = 64
+
+/*
+A range of the stream, that could not be recovered.
+*/
+type DamagedRange struct {
+	// The position and size of the damaged bytes within the stream.
+	Offset int64
+	Length int64
+	
+	// The amount of plaintext recovered before the damage.
+	Plain  int64
+	
+	// The number of chunks lost, as told by the chunk counters. Zero, if the
+	// damage extends to the end of the stream.
+	Chunks uint64
+}
+
+/*
+The outcome of a RecoveryReader.
+*/
+type RecoveryReport struct {
+	Damaged  []DamagedRange
+	
+	// The number of chunks recovered.
+	Chunks   uint64
+	
+	// The final chunk has been recovered.
+	Complete bool
+}
+
+// Nothing is damaged or missing.
+func (r *RecoveryReport) OK() bool { return r.Complete && len(r.Damaged)==0 }
+
+/*
+A Reader for damaged streams. Instead of stopping at the first damaged chunk, it skips
+it and continues with the next chunk, that passes authentication. Every chunk delivered
+is authenticated, but the plaintext has gaps, which are listed by Report.
+
+For AEAD ciphers, every chunk can be decrypted on its own: after damage, the stream is
+scanned for the next decodable Data record, which is authenticated with the chunk counters,
+that are likely given the number of bytes skipped. This works best with chunks of equal
+size, as written by Writer.
+
+Block and Stream ciphers carry their state from chunk to chunk. Damaged chunks can only
+be skipped, if their framing is intact (for instance, if bytes have been flipped, but none
+were inserted or removed). Otherwise, the rest of the stream is lost.
+
+The Preamble, Header and Metadata must be intact. Signatures are not verified, as the
+signature can not cover a stream with gaps. Everything after the final chunk is ignored.
+*/
+type RecoveryReader struct {
+	Reader
+	src    *bufio.Reader
+	pos    int64 // The stream offset of src.
+	window int
+	size   int   // The size of the last good record.
+	damage int64 // The start of the current damaged range, or -1.
+	report RecoveryReport
+}
+
+/*
+Creates a RecoveryReader. opt may be nil, in which case the defaults apply. Chunks larger than
+opt.MaxChunk are treated as damaged. opt.RequireSignature can not be satisfied, and fails with
+ENotRecoverable, as do version 0 streams.
+
+The Read method ends with io.EOF, even if the stream is damaged or truncated.
+Other errors (limits, I/O errors) are returned as *StreamError.
+*/
+func NewRecoveryReader(r io.Reader,decr Decrypter,opt *ReaderOptions) (*RecoveryReader,error) {
+	rec := newRecReader(r)
+	g := &RecoveryReader{damage:-1}
+	g.rec = rec
+	g.opt = opt.defaults()
+	if g.opt.RequireSignature { return nil,headerError(ENotRecoverable,rec) }
+	_,err := g.head.read(rec,decr,g.opt)
+	if err!=nil { return nil,headerError(err,rec) }
+	if g.version==0 { return nil,headerError(ENotRecoverable,rec) }
+	switch g.cipher.mode() {
+	case mBlock: g.coder = rBlock
+	case mStream: g.coder = rStream
+	case mAEAD: g.coder = rAEAD
+	default: return nil,headerError(EUnknownCipherType,rec)
+	}
+	g.size = g.maxRecord()
+	if g.size>g.opt.MaxChunk { g.size = g.opt.MaxChunk }
+	g.window = g.size+recordSlack
+	g.src = bufio.NewReaderSize(rec,g.window)
+	g.pos = rec.pos
+	return g,nil
+}
+
+/*
+Reports the damage found so far. It is complete, once Read returned io.EOF.
+*/
+func (r *RecoveryReader) Report() *RecoveryReport { return &r.report }
+
+func (r *RecoveryReader) Read(p []byte) (n int, err error) {
+	for {
+		m,_ := r.buffer.Read(p[n:])
+		n += m
+		if n==len(p) { return }
+		if r.errcd!=nil { err = r.errcd ; return }
+		r.errcd = r.next()
+	}
+}
+
+func (r *RecoveryReader) check(l int) error {
+	if l>r.window-recordSlack { return EChunkTooLarge }
+	return nil
+}
+
+// Reads the next good chunk into r.buffer.
+func (r *RecoveryReader) next() error {
+	if r.last { return io.EOF }
+	for {
+		buf,err := r.src.Peek(r.window)
+		if len(buf)==0 {
+			r.close(0)
+			if err!=nil && err!=io.EOF { return r.chunkError(err) }
+			return io.EOF
+		}
+		r.offset = r.pos
+		d := bytes.NewReader(buf)
+		err = r.codec.NewDecoder(d).DecodeData(&r.cached,r.check)
+		n := len(buf)-d.Len()
+		if r.cipher.mode()!=mAEAD {
+			if err!=nil || r.damage>=0 { return r.lose() }
+			ok,err := r.skip(n)
+			if err!=nil { return r.chunkError(err) }
+			if !ok { return r.lose() }
+			return nil
+		}
+		if err==nil {
+			ok,err := r.resync(n)
+			if err!=nil { return r.chunkError(err) }
+			if ok { return nil }
+		}
+		if r.damage<0 { r.damage = r.pos }
+		r.src.Discard(1)
+		r.pos++
+	}
+}
+
+/*
+AEAD ciphers: tries to authenticate the record in r.cached, with the chunk counters and
+key epochs possible after the current damage.
+*/
+func (r *RecoveryReader) resync(n int) (bool,error) {
+	c,e,ctr := r.cipher,r.epoch,r.counter
+	var lost,guess uint64
+	if r.damage>=0 {
+		skip := uint64(r.pos-r.damage)
+		lost = skip/uint64(r.cipher.AEAD.Overhead()+1)+1
+		guess = (skip+uint64(r.size)/2)/uint64(r.size)
+		if guess>lost { guess = lost }
+	}
+	if r.cached.Epoch<e || r.cached.Epoch-e>2*(lost+1) { return false,nil }
+	// The first chunk of an appended epoch brings its salt. A wrong one fails authentication.
+	if len(r.cached.Salt)!=0 {
+		if r.cached.Epoch==e || len(r.cached.Salt)>maxSalt { return false,nil }
+		r.setSalt(r.cached.Epoch,r.cached.Salt)
+	}
+	if r.seekEpoch(r.cached.Epoch)!=nil {
+		r.cipher,r.epoch = c,e
+		return false,nil
+	}
+	// Counters are tried in the order guess, guess+1, guess-1, guess+2, ...
+	tries := 0
+	for i := uint64(0); i<=2*lost && tries<recoverTries; i++ {
+		var k uint64
+		if i%2==0 {
+			if i/2>guess { continue }
+			k = guess-i/2
+		} else {
+			k = guess+(i+1)/2
+			if k>lost { continue }
+		}
+		tries++
+		r.counter = ctr+k
+		err := r.coder(&r.Reader)
+		if err==nil {
+			r.close(k)
+			return true,r.accept(n)
+		}
+		if _,ok := err.(LimitError); ok { return false,err }
+	}
+	r.cipher,r.epoch,r.counter = c,e,ctr
+	return false,nil
+}
+
+/*
+Block and Stream ciphers: reads the record in r.cached, or skips it, if it fails authentication.
+Returns false, if the cipher state can not be kept in sync.
+*/
+func (r *RecoveryReader) skip(n int) (bool,error) {
+	// A record without a proper tag is not taken for a chunk.
+	if len(r.cached.Tag)!=macSize { return false,nil }
+	if r.follow(r.cached.Epoch,r.cached.Salt)!=nil { return false,nil }
+	err := r.coder(&r.Reader)
+	switch err.(type) {
+	case nil: return true,r.accept(n)
+	case LimitError: return false,err
+	}
+	r.buffer.Reset()
+	// Only the authentication failure leaves the cipher state behind.
+	if err==EBlockAlignmentError { return false,nil }
+	if err==EAuthError {
+		r.temp = stretch(r.temp,len(r.cached.Data))
+		if r.cipher.mode()==mBlock {
+			r.cipher.Block.CryptBlocks(r.temp,r.cached.Data)
+		} else {
+			r.cipher.Stream.XORKeyStream(r.temp,r.cached.Data)
+		}
+		for i := range r.temp { r.temp[i] = 0 }
+	}
+	r.damage = r.pos
+	r.src.Discard(n)
+	r.pos += int64(n)
+	r.close(1)
+	r.counter++
+	return true,nil
+}
+
+// The rest of the stream is lost.
+func (r *RecoveryReader) lose() error {
+	if r.damage<0 { r.damage = r.pos }
+	n,err := io.Copy(ioutil.Discard,r.src)
+	r.pos += n
+	r.close(0)
+	if err!=nil { return r.chunkError(err) }
+	return io.EOF
+}
+
+// Ends the current damaged range.
+func (r *RecoveryReader) close(lost uint64) {
+	if r.damage<0 { return }
+	r.report.Damaged = append(r.report.Damaged,DamagedRange{
+		Offset:r.damage,
+		Length:r.pos-r.damage,
+		Plain:r.output,
+		Chunks:lost,
+	})
+	r.damage = -1
+}
+
+// Consumes a good record of n bytes, whose plaintext is in r.buffer.
+func (r *RecoveryReader) accept(n int) error {
+	r.src.Discard(n)
+	r.pos += int64(n)
+	r.size = n
+	if r.opt.MaxOutput>0 && r.output+int64(r.buffer.Len())>r.opt.MaxOutput {
+		r.buffer.Reset()
+		return LimitError("Output")
+	}
+	r.output += int64(r.buffer.Len())
+	r.last = r.cached.Last
+	r.counter++
+	r.report.Chunks++
+	r.report.Complete = r.last
+	return nil
+}
@@ -0,0 +1,114 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "bytes"
+import "io/ioutil"
+import "reflect"
+import "testing"
+
+func TestRecoveryReader(t *testing.T) {
+	const cs = 1024 // A multiple of the AES block size.
+	data := testData(5*cs+cs/2)
+	mid := func(o []int64,i int) int64 { return (o[i]+o[i+1])/2 }
+	flip := func(at ...func(o []int64) int64) func(ct []byte,o []int64) []byte {
+		return func(ct []byte,o []int64) []byte {
+			for _,a := range at { ct[a(o)] ^= 0x40 }
+			return ct
+		}
+	}
+	chunk := func(i int) func(o []int64) int64 { return func(o []int64) int64 { return mid(o,i) } }
+	for _,tc := range []struct{
+		name  string
+		mode  int
+		rekey int64
+		mod   func(ct []byte,o []int64) []byte
+		
+		// The chunks delivered, and the damage in terms of the offsets of the intact stream.
+		keep     []int
+		damaged  func(o []int64) []DamagedRange
+		complete bool
+	}{
+		{"intact",mAEAD,0,func(ct []byte,o []int64) []byte { return ct },
+			[]int{0,1,2,3,4,5},func(o []int64) []DamagedRange { return nil },true},
+		{"AEAD flipped",mAEAD,0,flip(chunk(2)),
+			[]int{0,1,3,4,5},func(o []int64) []DamagedRange { return []DamagedRange{{o[2],o[3]-o[2],2*cs,1}} },true},
+		{"Block flipped",mBlock,0,flip(chunk(2)),
+			[]int{0,1,3,4,5},func(o []int64) []DamagedRange { return []DamagedRange{{o[2],o[3]-o[2],2*cs,1}} },true},
+		{"Stream flipped",mStream,0,flip(chunk(2)),
+			[]int{0,1,3,4,5},func(o []int64) []DamagedRange { return []DamagedRange{{o[2],o[3]-o[2],2*cs,1}} },true},
+		{"AEAD inserted",mAEAD,0,func(ct []byte,o []int64) []byte {
+				at := mid(o,2)
+				return append(append(append([]byte(nil),ct[:at]...),make([]byte,7)...),ct[at:]...)
+			},
+			[]int{0,1,3,4,5},func(o []int64) []DamagedRange { return []DamagedRange{{o[2],o[3]+7-o[2],2*cs,1}} },true},
+		{"AEAD deleted",mAEAD,0,func(ct []byte,o []int64) []byte {
+				at := mid(o,2)
+				return append(append([]byte(nil),ct[:at]...),ct[at+7:]...)
+			},
+			[]int{0,1,3,4,5},func(o []int64) []DamagedRange { return []DamagedRange{{o[2],o[3]-7-o[2],2*cs,1}} },true},
+		// Chunks 0,1 are in epoch 0, chunks 2,3 in epoch 1 and chunks 4,5 in epoch 2.
+		{"AEAD epoch boundary",mAEAD,2,flip(chunk(1),chunk(2)),
+			[]int{0,3,4,5},func(o []int64) []DamagedRange { return []DamagedRange{{o[1],o[3]-o[1],cs,2}} },true},
+		{"AEAD epoch skipped",mAEAD,2,flip(chunk(1),chunk(2),chunk(3)),
+			[]int{0,4,5},func(o []int64) []DamagedRange { return []DamagedRange{{o[1],o[4]-o[1],cs,3}} },true},
+		{"Stream epoch boundary",mStream,2,flip(chunk(1),chunk(2)),
+			[]int{0,3,4,5},func(o []int64) []DamagedRange {
+				return []DamagedRange{{o[1],o[2]-o[1],cs,1},{o[2],o[3]-o[2],cs,1}}
+			},true},
+		{"Block framing",mBlock,0,func(ct []byte,o []int64) []byte { ct[o[2]] ^= 0xff; return ct },
+			[]int{0,1},func(o []int64) []DamagedRange { return []DamagedRange{{o[2],o[6]-o[2],2*cs,0}} },false},
+		{"AEAD truncated",mAEAD,0,func(ct []byte,o []int64) []byte { return ct[:o[4]+100] },
+			[]int{0,1,2,3},func(o []int64) []DamagedRange { return []DamagedRange{{o[4],100,4*cs,0}} },false},
+		{"Stream truncated",mStream,0,func(ct []byte,o []int64) []byte { return ct[:o[4]+100] },
+			[]int{0,1,2,3},func(o []int64) []DamagedRange { return []DamagedRange{{o[4],100,4*cs,0}} },false},
+		{"AEAD final chunk lost",mAEAD,0,func(ct []byte,o []int64) []byte { return ct[:o[5]] },
+			[]int{0,1,2,3,4},func(o []int64) []DamagedRange { return nil },false},
+	} {
+		t.Run(tc.name,func(t *testing.T) {
+			ts := &testSuite{Mode:tc.mode,Next:tc.rekey!=0}
+			ct := encryptAll(t,ts,&WriterOptions{ChunkSize:cs,RekeyChunks:tc.rekey},data)
+			o := chunkOffsets(t,ts,ct)
+			if len(o)!=7 { t.Fatalf("%d chunks, want 6",len(o)-1) }
+			ct = tc.mod(append([]byte(nil),ct...),o)
+			
+			r,err := NewRecoveryReader(bytes.NewReader(ct),ts,nil)
+			if err!=nil { t.Fatal(err) }
+			pt,err := ioutil.ReadAll(r)
+			if err!=nil { t.Fatal(err) }
+			var want []byte
+			for _,i := range tc.keep {
+				e := (i+1)*cs
+				if e>len(data) { e = len(data) }
+				want = append(want,data[i*cs:e]...)
+			}
+			if !bytes.Equal(pt,want) { t.Errorf("got %d bytes of plaintext, want %d",len(pt),len(want)) }
+			rep := r.Report()
+			if d := tc.damaged(o); !reflect.DeepEqual(rep.Damaged,d) { t.Errorf("Damaged: got %+v, want %+v",rep.Damaged,d) }
+			if rep.Complete!=tc.complete { t.Errorf("Complete: got %v, want %v",rep.Complete,tc.complete) }
+			if rep.Chunks!=uint64(len(tc.keep)) { t.Errorf("Chunks: got %d, want %d",rep.Chunks,len(tc.keep)) }
+			if rep.OK()!=(tc.complete && len(rep.Damaged)==0) { t.Error("OK") }
+		})
+	}
+}
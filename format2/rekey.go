@@ -0,0 +1,164 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package format2
+
+import "fmt"
+
+var (
+	ERekey = fmt.Errorf("Cipher does not support Rekeying")
+	EKeyExhausted = fmt.Errorf("Key usage limit reached and the Cipher does not support Rekeying")
+)
+
+/*
+Key epochs.
+
+Long streams are split into key epochs. Every epoch has its own cipher, which is
+derived from the one of the previous epoch (see CipherObject.Next). The epoch of a
+chunk is recorded in Data.Epoch, which is only encoded, if it isn't 0, and it is part
+of the associated data (see chunkAD). The epochs of the chunks must be ascending, the
+Reader follows them. Append starts a new epoch, which can skip one, if the final chunk
+was the only one of its epoch. So the epoch grows by at most two from chunk to chunk,
+and the Index lists the first chunk of the skipped epoch twice. The first chunk of an
+appended epoch carries its salt (Data.Salt), the Index lists it as well. A skipped epoch
+has been started by rekeying, as the first chunk of an appended one is never the final
+one, so it has no salt.
+
+The header tag, the Metadata and the Index always belong to epoch 0.
+For Stream ciphers, the key stream of every epoch after the first one starts at the
+first chunk of the epoch.
+*/
+type rekeyState struct {
+	chunks    int64 // The number of chunks in the current epoch.
+	bytes     int64 // The amount of ciphertext in the current epoch.
+	maxChunks int64
+	maxBytes  int64
+}
+
+/*
+Derives the usage limits of a single key from the properties of the cipher.
+Zero means unlimited.
+
+	Block size: the amount of data, after which the probability of a collision of
+	            two cipher blocks exceeds 2^-32 (2^(n/2-16) blocks of n bits).
+	Nonce size: AEAD ciphers with nonces of 12 bytes or less are limited to 2^32
+	            chunks per key, as recommended for GCM by NIST SP 800-38D.
+*/
+func limits(c *CipherObject) (chunks,bytes int64) {
+	bz := c.BlockSize
+	if c.mode()==mBlock { bz = c.Block.BlockSize() }
+	if bz>0 { bytes = birthday(bz) }
+	if c.mode()==mAEAD && c.AEAD.NonceSize()<=12 { chunks = 1<<32 }
+	return
+}
+func birthday(bz int) int64 {
+	e := (bz*8-32)/2
+	if e<=0 { return int64(bz) }
+	if e>=56 { return 0 }
+	return int64(bz)<<uint(e)
+}
+
+/*
+Sets up the rekeying of the writer, see WriterOptions.RekeyChunks.
+
+Ciphers without CipherObject.Next can't rekey. Unless limits are requested explicitly,
+which is an error, their streams remain in a single, unlimited epoch, as before.
+*/
+func (w *Writer) setupRekey(opt *WriterOptions) error {
+	k := &w.rekey
+	if w.cipher.Next==nil {
+		if opt.RekeyChunks>0 || opt.RekeyBytes>0 { return ERekey }
+		k.maxChunks,k.maxBytes = 0,0
+		return nil
+	}
+	k.maxChunks,k.maxBytes = limits(w.cipher)
+	if opt.RekeyChunks!=0 { k.maxChunks = opt.RekeyChunks }
+	if opt.RekeyBytes!=0 { k.maxBytes = opt.RekeyBytes }
+	return nil
+}
+
+/*
+Switches to the next key epoch, if a chunk of n more bytes would exceed the usage limits
+of the current one. Every epoch holds at least one chunk.
+*/
+func (w *Writer) rotate(n int) error {
+	k := &w.rekey
+	if k.chunks==0 { return nil }
+	if (k.maxChunks<=0 || k.chunks<k.maxChunks) && (k.maxBytes<=0 || k.bytes+int64(n)<=k.maxBytes) { return nil }
+	if w.cipher.Next==nil { return EKeyExhausted }
+	c,err := w.cipher.Next(nil)
+	if err!=nil { return err }
+	if c.mode()!=w.cipher.mode() { return EUnknownCipherType }
+	w.cipher = c
+	w.epoch++
+	k.chunks,k.bytes = 0,0
+	if w.index!=nil {
+		w.index.Epochs = append(w.index.Epochs,int64(w.counter))
+		w.index.Salts = append(w.index.Salts,nil)
+	}
+	return nil
+}
+
+const maxSalt = 64
+
+/*
+Follows the key epoch of the next chunk, which is the current one or one of the next two.
+The salt of the chunk belongs to the last epoch, that it starts.
+*/
+func (h *head) follow(epoch uint64,salt []byte) error {
+	if epoch<h.epoch || epoch-h.epoch>2 { return EMalformedRecord }
+	if len(salt)!=0 {
+		if epoch==h.epoch || len(salt)>maxSalt { return EMalformedRecord }
+		h.setSalt(epoch,salt)
+	}
+	for h.epoch<epoch {
+		err := h.nextEpoch()
+		if err!=nil { return err }
+	}
+	return nil
+}
+func (h *head) setSalt(epoch uint64,salt []byte) {
+	if h.salts==nil { h.salts = make(map[uint64][]byte) }
+	h.salts[epoch] = append([]byte(nil),salt...)
+}
+func (h *head) nextEpoch() error {
+	if h.cipher.Next==nil { return ERekey }
+	c,err := h.cipher.Next(h.salts[h.epoch+1])
+	if err!=nil { return err }
+	if c.mode()!=h.cipher.mode() { return EUnknownCipherType }
+	h.cipher = c
+	h.epoch++
+	return nil
+}
+
+/*
+Switches h.cipher to the given key epoch. Starts over from epoch 0, if it lies behind.
+For Stream ciphers, the key stream of h.cipher is not positioned.
+*/
+func (h *head) seekEpoch(epoch uint64) error {
+	if epoch<h.epoch { h.cipher,h.epoch = h.base,0 }
+	for h.epoch<epoch {
+		err := h.nextEpoch()
+		if err!=nil { return err }
+	}
+	return nil
+}
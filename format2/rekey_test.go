@@ -0,0 +1,47 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "bytes"
+import "testing"
+
+// A cipher without CipherObject.Next and with a 64-bit block is limited to 512KiB per key.
+// It must not run into EKeyExhausted, but stay in a single epoch.
+func TestRekeyWithoutNext(t *testing.T) {
+	ts := &testSuite{Mode:mStream,BlockSize:8}
+	data := testData(1<<20)
+	ct := encryptAll(t,ts,&WriterOptions{ChunkSize:4096},data)
+	if pt := decryptAll(t,ts,ct); !bytes.Equal(pt,data) { t.Fatal("plaintext mismatch") }
+	
+	_,err := NewWriter2(new(bytes.Buffer),ts,&WriterOptions{RekeyChunks:16})
+	if err!=ERekey { t.Fatalf("explicit limit: got %v, want ERekey",err) }
+}
+
+// With CipherObject.Next, the same limits rotate the key.
+func TestRekeyWithNext(t *testing.T) {
+	ts := &testSuite{Mode:mStream,BlockSize:8,Next:true}
+	data := testData(1<<20)
+	ct := encryptAll(t,ts,&WriterOptions{ChunkSize:4096},data)
+	if pt := decryptAll(t,ts,ct); !bytes.Equal(pt,data) { t.Fatal("plaintext mismatch") }
+}
@@ -0,0 +1,109 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "fmt"
+import "bytes"
+import "io"
+import "encoding/binary"
+
+var ENotRewrappable = fmt.Errorf("Stream can not be rewrapped")
+
+/*
+Replaces the key wrapping of a stream, see Rewrap.
+*/
+type Rewrapper interface {
+	// Returns a Preamble, that wraps the same content key for other recipients.
+	Rewrap(p *Preamble) (*Preamble,error)
+}
+
+/*
+Copies the stream from src to dst, replacing its Preamble with the one returned by rw.
+Returns the number of bytes written.
+
+Only streams with Preamble.Wrapped can be rewrapped, and the new Preamble has to be Wrapped
+and keep the Encoding. As the key wrapping is not part of the binding, everything else
+(the Header, the chunks, the Index and the signature) is copied as is, so streams of any
+size are rewrapped in one pass. Only the footer of the Index is adjusted to the new size
+of the Preamble. The content key is not checked; if rw returns a wrong one, the stream
+can not be decrypted anymore.
+
+The content key stays the same. Anyone, who kept it or the old Preamble, can still decrypt
+the stream. Revoking access requires re-encryption.
+*/
+func Rewrap(dst io.Writer,src io.Reader,rw Rewrapper,opt *ReaderOptions) (n int64,err error) {
+	rec := newRecReader(src)
+	var h head
+	_,err = h.parse(rec,opt.defaults())
+	if err!=nil { return 0,headerError(err,rec) }
+	if h.version==0 || !h.pre.Wrapped { return 0,ENotRewrappable }
+	pre,err := rw.Rewrap(h.pre)
+	if err!=nil { return 0,err }
+	if !pre.Wrapped || pre.Encoding!=h.pre.Encoding { return 0,ENotRewrappable }
+	pb,err := marshal(h.codec,func(e Encoder) error { return encodePreamble(e,pre) })
+	if err!=nil { return 0,err }
+	
+	raw := rec.rec
+	prefix := 4+len(codecID(h.codecName))
+	fw := &footerWriter{w:dst,delta:int64(len(pb))-(h.origin-int64(prefix))}
+	fw.Write(raw[:prefix])
+	fw.Write(pb)
+	fw.Write(raw[h.origin:])
+	rec.unlimit()
+	_,err = io.Copy(fw,rec)
+	if err==nil { err = fw.flush() }
+	return fw.n,err
+}
+
+/*
+Holds back the last footerSize bytes, to adjust the offset in the footer of an Index by delta.
+*/
+type footerWriter struct {
+	w     io.Writer
+	tail  []byte
+	delta int64
+	n     int64
+	err   error
+}
+func (f *footerWriter) Write(p []byte) (int,error) {
+	if f.err!=nil { return 0,f.err }
+	f.tail = append(f.tail,p...)
+	if k := len(f.tail)-footerSize; k>0 {
+		m,err := f.w.Write(f.tail[:k])
+		f.n += int64(m)
+		f.tail = f.tail[:copy(f.tail,f.tail[k:])]
+		if err!=nil { f.err = err; return 0,err }
+	}
+	return len(p),nil
+}
+func (f *footerWriter) flush() error {
+	if f.err!=nil { return f.err }
+	if len(f.tail)==footerSize && bytes.Equal(f.tail[8:],footerMagic) {
+		off := int64(binary.BigEndian.Uint64(f.tail))+f.delta
+		binary.BigEndian.PutUint64(f.tail,uint64(off))
+	}
+	m,err := f.w.Write(f.tail)
+	f.n += int64(m)
+	return err
+}
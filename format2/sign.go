@@ -0,0 +1,134 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "crypto/sha512"
+import "encoding/binary"
+import "fmt"
+import "hash"
+import "io"
+
+var (
+	ESignature = fmt.Errorf("Signature Verification Failed")
+	ENotSigned = fmt.Errorf("Stream is not signed")
+)
+
+type UnknownSignatureError string
+func (e UnknownSignatureError) Error() string { return "Unknown Signature Algorithm: "+string(e) }
+
+/*
+Signs a stream. See WriterOptions.Signer.
+*/
+type Signer interface {
+	// The signature algorithm, see RegisterVerifier.
+	SignatureAlgo() string
+	
+	// The public key of the signer. It is recorded in the Header.
+	SignerKey() []byte
+	
+	Sign(digest []byte) ([]byte,error)
+}
+
+// Reports, whether sig is a valid signature of digest for the public key pub.
+type Verifier func(pub,digest,sig []byte) bool
+
+var verifiers = make(map[string]Verifier)
+
+func RegisterVerifier(algo string,v Verifier) { verifiers[algo] = v }
+
+const maxSignature = 1024
+
+var signPrefix = []byte("format2-signature")
+
+/*
+The signature trailer. It follows the final Data record, if the stream is signed.
+
+The signature covers a SHA-512 hash over the binding, the encrypted Metadata and
+every Data record in order (chunk counter, final flag, length, ciphertext and tag).
+*/
+type Trailer struct {
+	_msgpack struct{} `msgpack:",asArray"`
+	Signature []byte
+}
+
+type signState struct {
+	h   hash.Hash
+	tmp []byte
+}
+func newSignState(binding,metaRaw []byte) *signState {
+	s := &signState{h:sha512.New()}
+	s.h.Write(signPrefix)
+	s.h.Write(binding)
+	s.field(metaRaw)
+	return s
+}
+func (s *signState) field(b []byte) {
+	var l [8]byte
+	binary.BigEndian.PutUint64(l[:],uint64(len(b)))
+	s.h.Write(l[:])
+	s.h.Write(b)
+}
+func (s *signState) chunk(counter uint64,d *Data) {
+	s.tmp = chunkAD(s.tmp,counter,d.Epoch,d.Last,nil,d.Salt)
+	s.h.Write(s.tmp)
+	s.field(d.Data)
+	s.field(d.Tag)
+}
+func (s *signState) digest() []byte { return s.h.Sum(nil) }
+
+func (w *Writer) writeTrailer() error {
+	sig,err := w.signer.Sign(w.sign.digest())
+	if err!=nil { return err }
+	return encodeRecord(w.enc,sig)
+}
+
+// Reads and verifies the trailer.
+func (r *Reader) readTrailer() error {
+	r.rec.limit(maxSignature+recordSlack,"Signature")
+	n,err := r.dec.DecodeArrayLen()
+	if err==io.EOF || err==io.ErrUnexpectedEOF { return ESignature }
+	if err!=nil { return err }
+	if n<1 { return ESignature }
+	sig,err := decodeBytes(r.dec,r.rec,nil,maxSignature,"Signature")
+	if err==io.EOF || err==io.ErrUnexpectedEOF { return ESignature }
+	if err!=nil { return err }
+	for i := 1; i<n; i++ {
+		err = r.dec.Skip()
+		if err!=nil { return err }
+	}
+	if !r.verifier(r.header.Signer,r.sign.digest(),sig) { return ESignature }
+	r.signed = true
+	return nil
+}
+
+/*
+Returns the signature algorithm and the public key of the signer, once the signature has
+been verified, that is after Read returned io.EOF. Otherwise, it returns "",nil.
+
+The application has to decide, whether it trusts the key.
+*/
+func (r *Reader) Signer() (algo string,pub []byte) {
+	if !r.signed { return "",nil }
+	return r.header.Signature,r.header.Signer
+}
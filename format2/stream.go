@@ -0,0 +1,151 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package format2
+
+import "context"
+import "time"
+import "io"
+import "fmt"
+
+/*
+Returned by EncryptStream and DecryptStream, if the context is cancelled or its
+deadline is exceeded. It wraps ctx.Err().
+*/
+type CanceledError struct {
+	Err error
+	
+	// The amount of plaintext processed so far.
+	Processed int64
+}
+func (e *CanceledError) Error() string { return fmt.Sprintf("%v after %d bytes",e.Err,e.Processed) }
+func (e *CanceledError) Unwrap() error { return e.Err }
+
+type StreamOptions struct {
+	// Passed to NewWriter2 (EncryptStream) or NewReader2 (DecryptStream). May be nil.
+	Writer *WriterOptions
+	Reader *ReaderOptions
+	
+	// If set, it is called with the total amount of plaintext processed so far.
+	Progress func(n int64)
+}
+
+type deadliner interface{ SetDeadline(t time.Time) error }
+
+func setDeadline(x interface{},t time.Time) {
+	if d,ok := x.(deadliner); ok { d.SetDeadline(t) }
+}
+
+/*
+Unblocks pending Read and Write calls on src and dst, once ctx is done, if they have a
+SetDeadline method (as net.Conn has). The returned function must be called on return.
+It waits for the goroutine, and clears the deadline again, if it has been set.
+*/
+func interrupt(ctx context.Context,src,dst interface{}) func() {
+	if ctx.Done()==nil { return func() {} }
+	stop := make(chan struct{})
+	done := make(chan bool,1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			setDeadline(src,time.Now())
+			setDeadline(dst,time.Now())
+			done <- true
+		case <-stop:
+			done <- false
+		}
+	}()
+	return func() {
+		close(stop)
+		if <-done {
+			setDeadline(src,time.Time{})
+			setDeadline(dst,time.Time{})
+		}
+	}
+}
+
+// Replaces err by a CanceledError, if ctx is done.
+func canceled(ctx context.Context,n int64,err error) error {
+	if err!=nil && ctx.Err()!=nil { return &CanceledError{Err:ctx.Err(),Processed:n} }
+	return err
+}
+
+/*
+Encrypts src into dst until io.EOF, like io.Copy into a Writer from NewWriter2.
+Returns the amount of plaintext.
+
+If ctx is done, it stops at the next chunk and returns a CanceledError. The stream
+is not closed in this case, so Readers will report it as truncated. If src or dst
+have a SetDeadline method (net.Conn), pending calls are unblocked by setting the
+deadline to the past. Before returning, the deadline is cleared (so a deadline set by
+the caller is lost, if ctx has been cancelled). The stream on the connection is broken,
+though. For src and dst without SetDeadline, cancellation is only checked between
+chunks, so a blocking Read or Write delays it.
+*/
+func EncryptStream(ctx context.Context,dst io.Writer,src io.Reader,encr Encrypter,opt *StreamOptions) (n int64,err error) {
+	if opt==nil { opt = new(StreamOptions) }
+	defer interrupt(ctx,src,dst)()
+	wr,err := NewWriter2(dst,encr,opt.Writer)
+	if err!=nil { return 0,canceled(ctx,0,err) }
+	buf := make([]byte,DefaultChunkSize)
+	for {
+		if ctx.Err()!=nil { return n,&CanceledError{Err:ctx.Err(),Processed:n} }
+		m,rerr := src.Read(buf)
+		if m>0 {
+			_,err = wr.Write(buf[:m])
+			if err!=nil { return n,canceled(ctx,n,err) }
+			n += int64(m)
+			if opt.Progress!=nil { opt.Progress(n) }
+		}
+		if rerr==io.EOF { break }
+		if rerr!=nil { return n,canceled(ctx,n,rerr) }
+	}
+	if ctx.Err()!=nil { return n,&CanceledError{Err:ctx.Err(),Processed:n} }
+	return n,canceled(ctx,n,wr.Close())
+}
+
+/*
+Decrypts src into dst, like io.Copy from a Reader from NewReader2. Returns the amount
+of plaintext.
+
+Cancellation works like in EncryptStream. Plaintext, that has been written to dst
+before the error, is authenticated, but incomplete.
+*/
+func DecryptStream(ctx context.Context,dst io.Writer,src io.Reader,decr Decrypter,opt *StreamOptions) (n int64,err error) {
+	if opt==nil { opt = new(StreamOptions) }
+	defer interrupt(ctx,src,dst)()
+	rd,err := NewReader2(src,decr,opt.Reader)
+	if err!=nil { return 0,canceled(ctx,0,err) }
+	buf := make([]byte,DefaultChunkSize)
+	for {
+		if ctx.Err()!=nil { return n,&CanceledError{Err:ctx.Err(),Processed:n} }
+		m,rerr := rd.Read(buf)
+		if m>0 {
+			_,err = dst.Write(buf[:m])
+			if err!=nil { return n,canceled(ctx,n,err) }
+			n += int64(m)
+			if opt.Progress!=nil { opt.Progress(n) }
+		}
+		if rerr==io.EOF { return n,nil }
+		if rerr!=nil { return n,canceled(ctx,n,rerr) }
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package format2
+
+import "bytes"
+import "context"
+import "errors"
+import "io"
+import "net"
+import "testing"
+import "time"
+
+func TestStreamProgress(t *testing.T) {
+	ts := &testSuite{Mode:mAEAD}
+	data := testData(3*DefaultChunkSize+100)
+	var last int64
+	progress := func(n int64) {
+		if n<=last { t.Errorf("progress went from %d to %d",last,n) }
+		last = n
+	}
+	buf := new(bytes.Buffer)
+	n,err := EncryptStream(context.Background(),buf,bytes.NewReader(data),ts,&StreamOptions{Progress:progress})
+	if err!=nil || n!=int64(len(data)) || last!=n { t.Fatalf("EncryptStream: %d, %v, progress %d",n,err,last) }
+	
+	last = 0
+	out := new(bytes.Buffer)
+	n,err = DecryptStream(context.Background(),out,buf,ts,&StreamOptions{Progress:progress})
+	if err!=nil || n!=int64(len(data)) || last!=n { t.Fatalf("DecryptStream: %d, %v, progress %d",n,err,last) }
+	if !bytes.Equal(out.Bytes(),data) { t.Fatal("plaintext mismatch") }
+}
+
+// Cancels the context after n bytes have been read. It has no SetDeadline method.
+type cancelReader struct {
+	r      io.Reader
+	n      int
+	cancel func()
+}
+func (c *cancelReader) Read(p []byte) (int,error) {
+	m,err := c.r.Read(p)
+	if c.n -= m; c.n<=0 { c.cancel() }
+	return m,err
+}
+
+func TestStreamCancel(t *testing.T) {
+	ts := &testSuite{Mode:mAEAD}
+	data := testData(4*DefaultChunkSize)
+	ct := encryptAll(t,ts,nil,data)
+	
+	ctx,cancel := context.WithCancel(context.Background())
+	src := &cancelReader{r:bytes.NewReader(data),n:DefaultChunkSize,cancel:cancel}
+	n,err := EncryptStream(ctx,new(bytes.Buffer),src,ts,nil)
+	var ce *CanceledError
+	if !errors.As(err,&ce) || !errors.Is(err,context.Canceled) { t.Fatalf("EncryptStream: got %v",err) }
+	if ce.Processed!=n || n!=DefaultChunkSize { t.Fatalf("EncryptStream: processed %d, returned %d",ce.Processed,n) }
+	
+	ctx,cancel = context.WithCancel(context.Background())
+	src = &cancelReader{r:bytes.NewReader(ct),n:len(ct)/2,cancel:cancel}
+	out := new(bytes.Buffer)
+	n,err = DecryptStream(ctx,out,src,ts,nil)
+	if !errors.As(err,&ce) || ce.Processed!=n { t.Fatalf("DecryptStream: got %v",err) }
+	if n>=int64(len(data)) || !bytes.Equal(out.Bytes(),data[:n]) { t.Fatalf("DecryptStream: %d bytes",n) }
+}
+
+// A Read, that blocks on a net.Conn, is interrupted, and the deadline is cleared afterwards.
+func TestStreamCancelConn(t *testing.T) {
+	ts := &testSuite{Mode:mAEAD}
+	a,b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ctx,cancel := context.WithTimeout(context.Background(),50*time.Millisecond)
+	defer cancel()
+	_,err := DecryptStream(ctx,new(bytes.Buffer),a,ts,nil)
+	var ce *CanceledError
+	if !errors.As(err,&ce) || !errors.Is(err,context.DeadlineExceeded) { t.Fatalf("got %v",err) }
+	
+	go b.Write([]byte("ping"))
+	buf := make([]byte,4)
+	_,err = io.ReadFull(a,buf)
+	if err!=nil { t.Fatalf("the deadline is still set: %v",err) }
+}
@@ -42,6 +42,20 @@ type CipherObject struct{
 	Block  cipher.BlockMode
 	Stream cipher.Stream
 	AEAD   cipher.AEAD
+	
+	// Optional: Returns a new cipher.Stream positioned 'offset' bytes into the key stream.
+	// Enables efficient random access for Stream ciphers (see SeekReader).
+	StreamAt func(offset int64) (cipher.Stream,error)
+	
+	// Optional: Returns the cipher of the next key epoch, with a key derived from this one
+	// and the salt. It must not depend on the state of the cipher. The salt is empty, unless
+	// the epoch is started by Append, which mixes a random one into it (different salts must
+	// give unrelated keys). Enables rekeying, see WriterOptions.RekeyChunks.
+	Next func(salt []byte) (*CipherObject,error)
+	
+	// Optional: The block size of the underlying block cipher of Stream and AEAD ciphers.
+	// Used to derive the usage limits of a key.
+	BlockSize int
 }
 func (c *CipherObject) mode() int {
 	if c.Block!=nil { return mBlock }
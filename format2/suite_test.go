@@ -0,0 +1,220 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "bytes"
+import "crypto/aes"
+import "crypto/cipher"
+import "crypto/sha256"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "testing"
+
+/*
+A cipher suite for the tests of this package, built from the standard library:
+AES-256-GCM (mAEAD), AES-256-CBC (mBlock) or AES-256-CTR (mStream). It is its own Encrypter
+and Decrypter.
+
+If Log is set, every use of a key of the AEAD and Stream ciphers is recorded in it.
+*/
+type testSuite struct {
+	Mode      int
+	Next      bool // Provide CipherObject.Next.
+	BlockSize int  // Reported in CipherObject.BlockSize.
+	Log       *keyLog
+}
+func (t *testSuite) StartEncryption() (*Preamble,*CipherObject,error) {
+	p := &Preamble{PK_Algo:"test",Encoding:"test"}
+	c,err := t.object(make([]byte,32),false)
+	return p,c,err
+}
+func (t *testSuite) StartDecryption(p *Preamble) (*CipherObject,error) {
+	if p.PK_Algo!="test" { return nil,fmt.Errorf("Not a test stream") }
+	return t.object(make([]byte,32),true)
+}
+func (t *testSuite) object(key []byte,decrypt bool) (*CipherObject,error) {
+	b,err := aes.NewCipher(key)
+	if err!=nil { return nil,err }
+	id := sha256.Sum256(key)
+	kid := binary.BigEndian.Uint64(id[:])
+	c := &CipherObject{BlockSize:t.BlockSize}
+	switch t.Mode {
+	case mAEAD:
+		g,err := cipher.NewGCM(b)
+		if err!=nil { return nil,err }
+		c.AEAD = &logAEAD{AEAD:g,log:t.Log,key:kid}
+	case mBlock:
+		iv := make([]byte,16)
+		c.Block = cipher.NewCBCEncrypter(b,iv)
+		if decrypt { c.Block = cipher.NewCBCDecrypter(b,iv) }
+	case mStream:
+		c.StreamAt = func(off int64) (cipher.Stream,error) {
+			var iv [16]byte
+			binary.BigEndian.PutUint64(iv[8:],uint64(off/16))
+			s := cipher.NewCTR(b,iv[:])
+			s.XORKeyStream(make([]byte,off%16),make([]byte,off%16))
+			return &logStream{Stream:s,log:t.Log,key:kid,pos:off},nil
+		}
+		c.Stream,_ = c.StreamAt(0)
+	default:
+		return nil,EUnknownCipherType
+	}
+	if t.Next {
+		c.Next = func(salt []byte) (*CipherObject,error) {
+			k := sha256.Sum256(append(append([]byte(nil),key...),salt...))
+			return t.object(k[:],decrypt)
+		}
+	}
+	return c,nil
+}
+
+/*
+Records the uses of all keys, which are told apart by their hash.
+
+AEAD ciphers: every nonce, that is passed to Seal, together with the input.
+Stream ciphers: every key stream byte, together with the two values it has been XORed
+with and into. Sealing or decrypting something, that has been sealed or encrypted
+before (for instance, to check a tag), is no new use.
+*/
+type keyLog struct {
+	nonces map[string][32]byte
+	stream map[[2]uint64]uint16
+	reuse  []string
+}
+func newKeyLog() *keyLog {
+	return &keyLog{nonces:make(map[string][32]byte),stream:make(map[[2]uint64]uint16)}
+}
+
+type logAEAD struct {
+	cipher.AEAD
+	log   *keyLog
+	key   uint64
+}
+func (a *logAEAD) Seal(dst,nonce,plaintext,ad []byte) []byte {
+	if a.log!=nil {
+		k := fmt.Sprintf("key %x, nonce %x",a.key,nonce)
+		in := sha256.Sum256(append(append([]byte(nil),plaintext...),ad...))
+		if o,ok := a.log.nonces[k]; ok && o!=in { a.log.reuse = append(a.log.reuse,k) }
+		a.log.nonces[k] = in
+	}
+	return a.AEAD.Seal(dst,nonce,plaintext,ad)
+}
+
+type logStream struct {
+	cipher.Stream
+	log   *keyLog
+	key   uint64
+	pos   int64
+}
+func (s *logStream) XORKeyStream(dst,src []byte) {
+	if s.log==nil { s.Stream.XORKeyStream(dst,src); s.pos += int64(len(src)); return }
+	in := append([]byte(nil),src...)
+	s.Stream.XORKeyStream(dst,src)
+	for i,b := range in {
+		// Unordered pair of plaintext and ciphertext.
+		p := uint16(b)<<8|uint16(dst[i])
+		if dst[i]<b { p = uint16(dst[i])<<8|uint16(b) }
+		k := [2]uint64{s.key,uint64(s.pos)+uint64(i)}
+		if o,ok := s.log.stream[k]; ok && o!=p {
+			s.log.reuse = append(s.log.reuse,fmt.Sprintf("key %x, key stream offset %d",k[0],k[1]))
+		}
+		s.log.stream[k] = p
+	}
+	s.pos += int64(len(src))
+}
+
+// Test data, that doesn't compress to nothing.
+func testData(n int) []byte {
+	b := make([]byte,n)
+	for i := range b { b[i] = byte(i*7+i/251) }
+	return b
+}
+
+// A file in memory, that implements AppendFile.
+type memFile struct { b []byte }
+func (m *memFile) ReadAt(p []byte,off int64) (int,error) {
+	if off>=int64(len(m.b)) { return 0,io.EOF }
+	n := copy(p,m.b[off:])
+	if n<len(p) { return n,io.EOF }
+	return n,nil
+}
+func (m *memFile) WriteAt(p []byte,off int64) (int,error) {
+	if e := off+int64(len(p)); e>int64(len(m.b)) { m.b = append(m.b,make([]byte,e-int64(len(m.b)))...) }
+	return copy(m.b[off:],p),nil
+}
+func (m *memFile) Truncate(size int64) error {
+	if size<int64(len(m.b)) { m.b = m.b[:size] }
+	return nil
+}
+
+func encryptAll(t *testing.T,enc Encrypter,opt *WriterOptions,data []byte) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	w,err := NewWriter2(buf,enc,opt)
+	if err!=nil { t.Fatal(err) }
+	_,err = w.Write(data)
+	if err!=nil { t.Fatal(err) }
+	err = w.Close()
+	if err!=nil { t.Fatal(err) }
+	return buf.Bytes()
+}
+func decryptAll(t *testing.T,decr Decrypter,ct []byte) []byte {
+	t.Helper()
+	r,err := NewReader2(bytes.NewReader(ct),decr,nil)
+	if err!=nil { t.Fatal(err) }
+	pt,err := ioutil.ReadAll(r)
+	if err!=nil { t.Fatal(err) }
+	return pt
+}
+
+// The offsets of the records of an intact stream: the start of every chunk, and the end of the final one.
+func chunkOffsets(t *testing.T,decr Decrypter,ct []byte) []int64 {
+	t.Helper()
+	r,err := newReader(bytes.NewReader(ct),decr,nil)
+	if err!=nil { t.Fatal(err) }
+	var offs []int64
+	p := make([]byte,1)
+	for !r.last {
+		r.buffer.Reset()
+		_,err = r.Read(p)
+		if err!=nil { t.Fatal(err) }
+		offs = append(offs,r.offset)
+	}
+	return append(offs,r.rec.pos)
+}
+
+// Decrypts ct, and returns the plaintext delivered before the first error.
+func readAll(decr Decrypter,ct []byte,opt *ReaderOptions) ([]byte,error) {
+	r,err := NewReader2(bytes.NewReader(ct),decr,opt)
+	if err!=nil { return nil,err }
+	return ioutil.ReadAll(r)
+}
+
+func expectError(t *testing.T,err,want error) {
+	t.Helper()
+	if !errors.Is(err,want) { t.Fatalf("got %v, want %v",err,want) }
+}
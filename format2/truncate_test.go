@@ -0,0 +1,63 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "bytes"
+import "errors"
+import "testing"
+
+// Chunks, that are cut off, dropped, reordered or replayed, must not go unnoticed.
+func TestTruncateReorder(t *testing.T) {
+	const cs = 1024
+	data := testData(4*cs+cs/2)
+	cat := func(parts ...[]byte) []byte {
+		var b []byte
+		for _,p := range parts { b = append(b,p...) }
+		return b
+	}
+	for _,mode := range []int{mAEAD,mBlock,mStream} {
+		ts := &testSuite{Mode:mode}
+		ct := encryptAll(t,ts,&WriterOptions{ChunkSize:cs},data)
+		o := chunkOffsets(t,ts,ct)
+		rec := func(i int) []byte { return ct[o[i]:o[i+1]] }
+		for _,tc := range []struct{
+			name string
+			ct   []byte
+			want error
+			good int // The number of chunks delivered.
+		}{
+			{"final chunk cut off",ct[:o[4]],ETruncated,4},
+			{"record cut",ct[:o[3]+10],ETruncated,3},
+			{"everything cut off",ct[:o[0]],ETruncated,0},
+			{"reordered",cat(ct[:o[1]],rec(2),rec(1),ct[o[3]:]),EAuthError,1},
+			{"dropped",cat(ct[:o[1]],ct[o[2]:]),EAuthError,1},
+			{"replayed",cat(ct[:o[2]],rec(1),ct[o[2]:]),EAuthError,2},
+			{"final chunk moved",cat(ct[:o[1]],rec(4)),EAuthError,1},
+		} {
+			pt,err := readAll(ts,tc.ct,nil)
+			if !bytes.Equal(pt,data[:tc.good*cs]) { t.Errorf("mode %d, %s: got %d bytes of plaintext, want %d",mode,tc.name,len(pt),tc.good*cs) }
+			if !errors.Is(err,tc.want) { t.Errorf("mode %d, %s: got %v, want %v",mode,tc.name,err,tc.want) }
+		}
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "bytes"
+import "crypto/cipher"
+import "errors"
+import "testing"
+
+func TestUnpadd(t *testing.T) {
+	const bs = 16
+	for n := 0; n<bs; n++ {
+		lb := testData(bs)
+		padd(lb[n:])
+		z,err := unpadd(lb)
+		if err!=nil || z!=n { t.Errorf("padd: %d bytes of data, got %d, %v",n,z,err) }
+		lb = testData(bs)
+		paddPKCS7(lb[n:])
+		z,err = unpaddPKCS7(lb)
+		if err!=nil || z!=n { t.Errorf("PKCS#7: %d bytes of data, got %d, %v",n,z,err) }
+	}
+	for _,lb := range [][]byte{
+		{1,1,1,1}, // No 0 byte.
+		{9,0,1,2}, // Inconsistent run.
+		{9,9,9,4}, // Longer than the block.
+	} {
+		if _,err := unpadd(lb); err!=EAuthError { t.Errorf("padd %v: got %v, want EAuthError",lb,err) }
+	}
+	for _,lb := range [][]byte{
+		{9,9,9,0}, // Zero padding.
+		{9,9,1,2}, // Inconsistent run.
+		{5,5,5,5}, // Longer than the block.
+		{0,0,0,0},
+	} {
+		if _,err := unpaddPKCS7(lb); err!=EAuthError { t.Errorf("PKCS#7 %v: got %v, want EAuthError",lb,err) }
+	}
+}
+
+// Applies mod to the last plaintext block, while on is set.
+type badPadding struct {
+	cipher.BlockMode
+	on  *bool
+	mod func(lb []byte)
+}
+func (b *badPadding) CryptBlocks(dst,src []byte) {
+	if *b.on {
+		src = append([]byte(nil),src...)
+		b.mod(src[len(src)-b.BlockSize():])
+	}
+	b.BlockMode.CryptBlocks(dst,src)
+}
+type badPaddingSuite struct {
+	*testSuite
+	badPadding
+}
+func (s *badPaddingSuite) StartEncryption() (*Preamble,*CipherObject,error) {
+	p,c,err := s.testSuite.StartEncryption()
+	if err!=nil { return nil,nil,err }
+	s.BlockMode = c.Block
+	c.Block = &s.badPadding
+	return p,c,err
+}
+
+func TestBlockPadding(t *testing.T) {
+	ts := &testSuite{Mode:mBlock}
+	for _,pkcs7 := range []bool{false,true} {
+		for _,n := range []int{0,1,15,16,17,1023,1024,1025,3000} {
+			data := testData(n)
+			ct := encryptAll(t,ts,&WriterOptions{ChunkSize:1024,PKCS7:pkcs7},data)
+			if pt := decryptAll(t,ts,ct); !bytes.Equal(pt,data) { t.Errorf("PKCS7 %v, %d bytes: plaintext mismatch",pkcs7,n) }
+		}
+	}
+	
+	// The final block of 20 bytes of data has 4 bytes of data and 12 bytes of padding.
+	data := testData(20)
+	for _,tc := range []struct{
+		name  string
+		pkcs7 bool
+		mod   func(lb []byte)
+	}{
+		{"zero padding",true,func(lb []byte) { lb[15] = 0 }},
+		{"padding too long",true,func(lb []byte) { lb[15] = 17 }},
+		{"inconsistent PKCS#7 padding",true,func(lb []byte) { lb[14] ^= 1 }},
+		{"no 0 byte",false,func(lb []byte) { lb[4] = 11 }},
+		{"padding too long",false,func(lb []byte) { lb[15] = 16 }},
+		{"inconsistent padding",false,func(lb []byte) { lb[10] ^= 1 }},
+	} {
+		on := false
+		bs := &badPaddingSuite{testSuite:ts,badPadding:badPadding{on:&on,mod:tc.mod}}
+		buf := new(bytes.Buffer)
+		w,err := NewWriter2(buf,bs,&WriterOptions{PKCS7:tc.pkcs7})
+		if err!=nil { t.Fatal(err) }
+		_,err = w.Write(data)
+		if err!=nil { t.Fatal(err) }
+		on = true
+		err = w.Close()
+		if err!=nil { t.Fatal(err) }
+		pt,err := readAll(ts,buf.Bytes(),nil)
+		if !errors.Is(err,EAuthError) || len(pt)!=0 { t.Errorf("PKCS7 %v, %s: got %d bytes, %v",tc.pkcs7,tc.name,len(pt),err) }
+	}
+}
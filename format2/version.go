@@ -0,0 +1,124 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "fmt"
+import "bytes"
+import "io"
+
+var EBadMagic = fmt.Errorf("Not a format2 Stream")
+
+/*
+The format version is unsupported. Version 0 denotes legacy streams without magic,
+see ReaderOptions.Legacy.
+*/
+type UnsupportedVersionError int
+func (e UnsupportedVersionError) Error() string { return fmt.Sprintf("Unsupported format2 Version: %d",int(e)) }
+
+/*
+Every stream starts with the magic, followed by a one-byte version number:
+
+	[3 bytes] 0xC1 'F' '2'
+	[1 byte ] Version
+
+0xC1 is never used by msgpack, so streams written before the magic was introduced
+(version 0) start with a different byte. The magic and the version are part of the
+binding, see makeBinding. Streams, that are not encoded with msgpack, name their
+codec next, see codecMark.
+*/
+const Version = 1
+var magic = []byte{0xc1,'F','2'}
+
+/*
+Reads the magic and returns the version. Returns 0, if the stream has no magic.
+*/
+func readMagic(r *recReader) (int,error) {
+	b,err := r.Peek(1)
+	if err!=nil { return 0,err }
+	if b[0]!=magic[0] { return 0,nil }
+	var m [4]byte
+	_,err = io.ReadFull(r,m[:])
+	if err!=nil { return 0,err }
+	if !bytes.Equal(m[:3],magic) || m[3]==0 { return 0,EBadMagic }
+	return int(m[3]),nil
+}
+
+/*
+Starts the decryption of a version 0 stream. Such streams have no Header.
+*/
+func (h *head) readLegacy(rec *recReader,decr Decrypter,opt *ReaderOptions) (err error) {
+	if !opt.Legacy { return UnsupportedVersionError(0) }
+	h.cipher,err = decr.StartDecryption(h.pre)
+	if err!=nil { return &StreamError{Kind:KindKey,Chunk:-1,Err:err} }
+	h.base = h.cipher
+	h.header.MaxChunk = int64(opt.MaxChunk)
+	rec.stop()
+	rec.unlimit()
+	return
+}
+
+/*
+Coders for version 0 streams: AEAD chunks carry their own nonce, followed by the associated data.
+Block and Stream ciphers are not authenticated.
+*/
+func rLegacyBlock(r *Reader) error {
+	if (len(r.cached.Data)%r.cipher.Block.BlockSize())!=0 {
+		return EBlockAlignmentError
+	}
+	r.temp = stretch(r.temp,len(r.cached.Data))
+	r.cipher.Block.CryptBlocks(r.temp,r.cached.Data)
+	if r.cached.Last && len(r.temp)!=0 {
+		sz := len(r.temp)-r.cipher.Block.BlockSize()
+		n,err := unpadd(r.temp[sz:])
+		if err!=nil {
+			for i := range r.temp { r.temp[i] = 0 }
+			return err
+		}
+		r.temp = r.temp[:sz+n]
+	}
+	r.buffer.Write(r.temp)
+	for i := range r.temp { r.temp[i] = 0 }
+	return nil
+}
+func rLegacyStream(r *Reader) error {
+	r.temp = stretch(r.temp,len(r.cached.Data))
+	r.cipher.Stream.XORKeyStream(r.temp,r.cached.Data)
+	r.buffer.Write(r.temp)
+	for i := range r.temp { r.temp[i] = 0 }
+	return nil
+}
+func rLegacyAEAD(r *Reader) error {
+	nz := r.cipher.AEAD.NonceSize()
+	if len(r.cached.Nonce)<nz { return ENonceError }
+	r.temp = stretch(r.temp,len(r.cached.Data))
+	var err error
+	r.temp,err = r.cipher.AEAD.Open(r.temp[:0],r.cached.Nonce[:nz],r.cached.Data,r.cached.Nonce[nz:])
+	if err==nil {
+		r.buffer.Write(r.temp)
+	} else {
+		err = EAuthError
+	}
+	for i := range r.temp { r.temp[i] = 0 }
+	return err
+}
@@ -0,0 +1,111 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package format2
+
+import "github.com/vmihailenco/msgpack"
+import "bytes"
+import "errors"
+import "testing"
+
+/*
+Writes a version 0 stream, as NewWriter did before the magic was introduced:
+the Preamble, followed by Data records without a final one. AEAD chunks carry their own nonce.
+*/
+func legacyStream(t *testing.T,ts *testSuite,data []byte,cs int) []byte {
+	t.Helper()
+	type preamble struct {
+		_msgpack struct{} `msgpack:",asArray"`
+		Opaque   []byte
+		PK_Algo  string
+		Encoding string
+	}
+	type record struct {
+		_msgpack struct{} `msgpack:",asArray"`
+		Last  bool
+		Nonce []byte
+		Data  []byte
+	}
+	pre,c,err := ts.StartEncryption()
+	if err!=nil { t.Fatal(err) }
+	buf := new(bytes.Buffer)
+	enc := msgpack.NewEncoder(buf)
+	err = enc.Encode(&preamble{Opaque:pre.Opaque,PK_Algo:pre.PK_Algo,Encoding:pre.Encoding})
+	if err!=nil { t.Fatal(err) }
+	for i := 0; i<len(data); i += cs {
+		p := data[i:]
+		if len(p)>cs { p = p[:cs] }
+		rec := &record{Data:make([]byte,len(p))}
+		switch c.mode() {
+		case mStream: c.Stream.XORKeyStream(rec.Data,p)
+		case mAEAD:
+			rec.Nonce = make([]byte,c.AEAD.NonceSize()+4)
+			rec.Nonce[0] = byte(i/cs)
+			rec.Data = c.AEAD.Seal(nil,rec.Nonce[:c.AEAD.NonceSize()],p,rec.Nonce[c.AEAD.NonceSize():])
+		}
+		err = enc.Encode(rec)
+		if err!=nil { t.Fatal(err) }
+	}
+	return buf.Bytes()
+}
+
+func TestVersion(t *testing.T) {
+	data := testData(3000)
+	ts := &testSuite{Mode:mAEAD}
+	ct := encryptAll(t,ts,nil,data)
+	if !bytes.Equal(ct[:4],append(magic,Version)) { t.Fatalf("stream starts with %x",ct[:4]) }
+	for _,tc := range []struct{
+		name string
+		mod  func(c []byte)
+		want error
+	}{
+		{"newer version",func(c []byte) { c[3] = Version+1 },UnsupportedVersionError(Version+1)},
+		{"version 0",func(c []byte) { c[3] = 0 },EBadMagic},
+		{"bad magic",func(c []byte) { c[2] = '3' },EBadMagic},
+	} {
+		c := append([]byte(nil),ct...)
+		tc.mod(c)
+		for _,opt := range []*ReaderOptions{nil,{Legacy:true}} {
+			pt,err := readAll(ts,c,opt)
+			if !errors.Is(err,tc.want) || len(pt)!=0 { t.Errorf("%s: got %v, want %v",tc.name,err,tc.want) }
+		}
+	}
+	
+	// A stream, whose magic has been stripped, is no valid version 0 stream.
+	pt,err := readAll(ts,ct[4:],&ReaderOptions{Legacy:true})
+	if err==nil || len(pt)!=0 { t.Errorf("stripped magic: got %d bytes, %v",len(pt),err) }
+}
+
+func TestLegacy(t *testing.T) {
+	data := testData(3000)
+	for _,mode := range []int{mAEAD,mStream} {
+		ts := &testSuite{Mode:mode}
+		ct := legacyStream(t,ts,data,1000)
+		_,err := readAll(ts,ct,nil)
+		var ve UnsupportedVersionError
+		if !errors.As(err,&ve) || ve!=0 { t.Errorf("mode %d: got %v, want UnsupportedVersionError(0)",mode,err) }
+		pt,err := readAll(ts,ct,&ReaderOptions{Legacy:true})
+		if err!=nil { t.Fatalf("mode %d: %v",mode,err) }
+		if !bytes.Equal(pt,data) { t.Errorf("mode %d: plaintext mismatch",mode) }
+	}
+}
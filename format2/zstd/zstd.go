@@ -0,0 +1,67 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+Registers the Zstandard compression algorithm for format2.
+
+	Compression = (
+		"zstd"
+	)
+*/
+package zstd
+
+import (
+	izstd "github.com/klauspost/compress/zstd"
+	
+	"github.com/mad-day/cryptoinfra/format2"
+)
+
+type compressor struct {
+	enc *izstd.Encoder
+	dec *izstd.Decoder
+}
+
+func (c *compressor) Compress(dst,src []byte) ([]byte,error) {
+	return c.enc.EncodeAll(src,dst),nil
+}
+func (c *compressor) Decompress(dst,src []byte,max int) ([]byte,error) {
+	// With WithDecodeAllCapLimit, DecodeAll does not grow dst beyond its capacity.
+	if cap(dst)-len(dst)<max {
+		ndst := make([]byte,len(dst),len(dst)+max)
+		copy(ndst,dst)
+		dst = ndst
+	}
+	out,err := c.dec.DecodeAll(src,dst[:len(dst):len(dst)+max])
+	if err==izstd.ErrDecoderSizeExceeded { err = format2.LimitError("Decompression") }
+	return out,err
+}
+
+var _ format2.Compressor = (*compressor)(nil)
+
+func init() {
+	enc,err := izstd.NewWriter(nil)
+	if err!=nil { panic(err) }
+	dec,err := izstd.NewReader(nil,izstd.WithDecodeAllCapLimit(true),izstd.WithDecoderConcurrency(0))
+	if err!=nil { panic(err) }
+	format2.RegisterCompression("zstd",&compressor{enc,dec})
+}
@@ -0,0 +1,116 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package zstd
+
+import (
+	izstd "github.com/klauspost/compress/zstd"
+	
+	"github.com/mad-day/cryptoinfra/format2"
+	
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"io/ioutil"
+	"runtime"
+	"testing"
+)
+
+// AES-256-GCM with a fixed key.
+type testSuite struct{}
+func (testSuite) StartEncryption() (*format2.Preamble,*format2.CipherObject,error) {
+	p := &format2.Preamble{PK_Algo:"test",Encoding:"aes-256/gcm"}
+	c,err := testSuite{}.StartDecryption(p)
+	return p,c,err
+}
+func (testSuite) StartDecryption(p *format2.Preamble) (*format2.CipherObject,error) {
+	b,err := aes.NewCipher(make([]byte,32))
+	if err!=nil { return nil,err }
+	g,err := cipher.NewGCM(b)
+	if err!=nil { return nil,err }
+	return &format2.CipherObject{AEAD:g},nil
+}
+
+func encrypt(t *testing.T,comp string,cs int,data []byte) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	w,err := format2.NewWriter2(buf,testSuite{},&format2.WriterOptions{ChunkSize:cs,Compression:comp})
+	if err!=nil { t.Fatal(err) }
+	_,err = w.Write(data)
+	if err==nil { err = w.Close() }
+	if err!=nil { t.Fatal(err) }
+	return buf.Bytes()
+}
+
+func decrypt(ct []byte,opt *format2.ReaderOptions) ([]byte,error) {
+	r,err := format2.NewReader2(bytes.NewReader(ct),testSuite{},opt)
+	if err!=nil { return nil,err }
+	return ioutil.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	data := append(bytes.Repeat([]byte("All work and no play makes Jack a dull boy. "),300),make([]byte,5000)...)
+	plain := encrypt(t,"",1024,data)
+	ct := encrypt(t,"zstd",1024,data)
+	pt,err := decrypt(ct,nil)
+	if err!=nil || !bytes.Equal(pt,data) { t.Fatal(err) }
+	if len(ct)>len(plain)/4 { t.Errorf("%d bytes compressed, %d uncompressed",len(ct),len(plain)) }
+}
+
+// Compresses every chunk into a bomb, that decompresses to much more than a chunk.
+type bombCompressor struct {
+	*compressor
+	bomb []byte
+}
+func (b bombCompressor) Compress(dst,src []byte) ([]byte,error) { return append(dst,b.bomb...),nil }
+
+func TestDecompressionBomb(t *testing.T) {
+	const cs = 64<<10
+	zc := new(compressor)
+	zc.enc,_ = izstd.NewWriter(nil)
+	zc.dec,_ = izstd.NewReader(nil,izstd.WithDecodeAllCapLimit(true),izstd.WithDecoderConcurrency(0))
+	bomb,_ := zc.Compress(nil,make([]byte,32<<20))
+	format2.RegisterCompression("zstd-bomb",bombCompressor{zc,bomb})
+	
+	for _,tc := range []struct{
+		name string
+		comp string
+		data []byte
+		opt  *format2.ReaderOptions
+	}{
+		// The bomb exceeds the MaxChunk of the Header.
+		{"bomb","zstd-bomb",bytes.Repeat([]byte("0123456789abcdef"),cs/16),nil},
+		// A chunk, that is allowed by the Header, exceeds ReaderOptions.MaxChunk.
+		{"MaxChunk","zstd",make([]byte,cs),&format2.ReaderOptions{MaxChunk:cs/4}},
+	} {
+		ct := encrypt(t,tc.comp,cs,tc.data)
+		var a,b runtime.MemStats
+		runtime.ReadMemStats(&a)
+		pt,err := decrypt(ct,tc.opt)
+		runtime.ReadMemStats(&b)
+		if n := b.TotalAlloc-a.TotalAlloc; n>8<<20 { t.Errorf("%s: %d bytes allocated",tc.name,n) }
+		var le format2.LimitError
+		if !errors.As(err,&le) || le!="Decompression" || len(pt)!=0 { t.Errorf("%s: got %d bytes, %v, want LimitError(Decompression)",tc.name,len(pt),err) }
+	}
+}